@@ -0,0 +1,484 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"code.google.com/p/tcgl/redis"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Password reset and email verification tokens are kept in the session
+// database under the SHA-256 of the token, like sessions, and are deleted
+// when used. The tokens of each kind issued to a pid are kept in a set so
+// that they can be revoked together. Profiles are indexed by email address in
+// EMAIL_PIDS so that users can log in or reset their password by email.
+
+const (
+	EMAIL_PIDS = "emailpids"
+
+	tokenPasswordReset = "reset"
+	tokenVerifyEmail   = "verifyemail"
+)
+
+var (
+	ErrInvalidToken = errors.New("datastore: token not found, expired or already used")
+	ErrEmailInUse   = errors.New("datastore: email address belongs to another profile")
+	ErrNoEmail      = errors.New("datastore: profile has no email address")
+)
+
+type accountToken struct {
+	Pid   PidType `json:"pid"`
+	Email string  `json:"email,omitempty"` // the address being verified
+}
+
+func accountTokenKey(kind string, token string) string {
+	return fmt.Sprintf("token:%s:%s", kind, sessionTokenId(token))
+}
+
+func accountTokensKey(kind string, pid PidType) string {
+	return fmt.Sprintf("tokens:%s:%s", kind, pid)
+}
+
+// Emails are matched ignoring case and surrounding space
+func normaliseEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+func decodeAccountToken(data string) (*accountToken, error) {
+	t := &accountToken{}
+	if err := json.Unmarshal([]byte(data), t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Deletes a hash field if it holds the given value.
+// KEYS: hash
+// ARGV: field, value
+var hdelIfEqualScript = newLuaScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+// Records email as belonging to pid, failing with ErrEmailInUse if it belongs
+// to another profile
+func (s *RedisStore) indexEmail(pid PidType, email string) error {
+	email = normaliseEmail(email)
+	if email == "" {
+		return nil
+	}
+
+	rs := s.pdb.Command("HSETNX", EMAIL_PIDS, email, pid)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	if set, _ := rs.ValueAsBool(); set {
+		return nil
+	}
+
+	rs = s.pdb.Command("HGET", EMAIL_PIDS, email)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	if PidType(rs.ValueAsString()) != pid {
+		return ErrEmailInUse
+	}
+
+	return nil
+}
+
+func (s *RedisStore) unindexEmail(pid PidType, email string) error {
+	email = normaliseEmail(email)
+	if email == "" {
+		return nil
+	}
+
+	rs := hdelIfEqualScript.run(s.pdb, []string{EMAIL_PIDS}, email, string(pid))
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// Updates the email index when a profile's email changes. The address is no
+// longer verified.
+func (s *RedisStore) changeEmail(pid PidType, oldEmail string, newEmail string) error {
+	if normaliseEmail(oldEmail) == normaliseEmail(newEmail) {
+		return nil
+	}
+
+	if err := s.unindexEmail(pid, oldEmail); err != nil {
+		return err
+	}
+
+	rs := s.pdb.Command("HDEL", profileKey(pid), "emailverified")
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// Indexes the email address of every profile, returning the number indexed.
+// Only needed for profiles added before the index was maintained. Addresses
+// shared by several profiles stay with whichever was indexed first.
+func (s *RedisStore) RebuildEmailIndex() (int, error) {
+	n := 0
+
+	err := scanProfiles(s.pdb, func(pids []PidType) error {
+		for _, pid := range pids {
+			rs := s.pdb.Command("HGET", profileKey(pid), "email")
+			if !rs.IsOK() {
+				if isKeyNotFound(rs.Error()) {
+					continue
+				}
+				return rs.Error()
+			}
+			if normaliseEmail(rs.ValueAsString()) == "" {
+				continue
+			}
+
+			if err := s.indexEmail(pid, rs.ValueAsString()); err != nil {
+				if err == ErrEmailInUse {
+					applog.Errorf("Not indexing email of %s: %s", pid, err.Error())
+					continue
+				}
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+
+	return n, err
+}
+
+// Finds the profile with the given email address
+func (s *RedisStore) PidForEmail(email string) (PidType, error) {
+	rs := s.pdb.Command("HGET", EMAIL_PIDS, normaliseEmail(email))
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	return PidType(rs.ValueAsString()), nil
+}
+
+func (s *RedisStore) newAccountToken(kind string, t *accountToken, lifetime int) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	key := accountTokenKey(kind, token)
+	tokensKey := accountTokensKey(kind, t.Pid)
+	rs := s.sdb.MultiCommand(func(mc *redis.MultiCommand) {
+		mc.Command("SET", key, data, "EX", lifetime)
+		mc.Command("SADD", tokensKey, key)
+		mc.Command("EXPIRE", tokensKey, lifetime)
+	})
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	return token, nil
+}
+
+// Deletes every token of a kind issued to pid
+func (s *RedisStore) revokeAccountTokens(kind string, pid PidType) error {
+	tokensKey := accountTokensKey(kind, pid)
+
+	rs := s.sdb.Command("SMEMBERS", tokensKey)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	keys := append(rs.ValuesAsStrings(), tokensKey)
+	args := make([]interface{}, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+
+	rs = s.sdb.Command("DEL", args...)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+func (s *RedisStore) takeAccountToken(kind string, token string) (*accountToken, error) {
+	rs := takeScript.run(s.sdb, []string{accountTokenKey(kind, token)})
+	if !rs.IsOK() {
+		if isKeyNotFound(rs.Error()) {
+			return nil, ErrInvalidToken
+		}
+		return nil, rs.Error()
+	}
+
+	return decodeAccountToken(rs.ValueAsString())
+}
+
+// Creates a token that can be used once, within Config.Account.ResetLifetime
+// seconds, to set a new password for pid with ResetPassword
+func (s *RedisStore) PasswordResetToken(pid PidType) (string, error) {
+	rs := s.pdb.Command("EXISTS", profileKey(pid))
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+	if exists, _ := rs.ValueAsBool(); !exists {
+		return "", ErrKeyNotFound
+	}
+
+	return s.newAccountToken(tokenPasswordReset, &accountToken{Pid: pid}, s.config.Account.ResetLifetime)
+}
+
+// Sets a new password using a token from PasswordResetToken, returning the
+// pid the token was issued for. The token is only used up if the password
+// meets Config.Passwords. The profile's other reset tokens and sessions are
+// ended and any login lockout is cleared.
+func (s *RedisStore) ResetPassword(token string, password string) (PidType, error) {
+	rs := s.sdb.Command("GET", accountTokenKey(tokenPasswordReset, token))
+	if !rs.IsOK() {
+		if isKeyNotFound(rs.Error()) {
+			return "", ErrInvalidToken
+		}
+		return "", rs.Error()
+	}
+
+	t, err := decodeAccountToken(rs.ValueAsString())
+	if err != nil {
+		return "", err
+	}
+	if err := s.config.Passwords.Check(t.Pid, password); err != nil {
+		return "", err
+	}
+
+	if t, err = s.takeAccountToken(tokenPasswordReset, token); err != nil {
+		return "", err
+	}
+
+	if err := s.setPassword(t.Pid, password); err != nil {
+		return t.Pid, err
+	}
+
+	if err := s.revokeAccountTokens(tokenPasswordReset, t.Pid); err != nil {
+		return t.Pid, err
+	}
+
+	if _, err := s.LogoutAll(t.Pid); err != nil {
+		return t.Pid, err
+	}
+
+	return t.Pid, s.UnlockLogin(t.Pid)
+}
+
+// Creates a token that can be used once, within Config.Account.VerifyLifetime
+// seconds, to confirm pid's current email address with VerifyEmail
+func (s *RedisStore) EmailVerificationToken(pid PidType) (string, error) {
+	rs := s.pdb.Command("HGET", profileKey(pid), "email")
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	email := rs.ValueAsString()
+	if email == "" {
+		return "", ErrNoEmail
+	}
+
+	return s.newAccountToken(tokenVerifyEmail, &accountToken{Pid: pid, Email: normaliseEmail(email)}, s.config.Account.VerifyLifetime)
+}
+
+// Marks a profile's email address as verified using a token from
+// EmailVerificationToken, returning the pid the token was issued for. The
+// token is invalid if the address has changed since it was issued.
+func (s *RedisStore) VerifyEmail(token string) (PidType, error) {
+	t, err := s.takeAccountToken(tokenVerifyEmail, token)
+	if err != nil {
+		return "", err
+	}
+
+	rs := s.pdb.Command("HGET", profileKey(t.Pid), "email")
+	if !rs.IsOK() {
+		if isKeyNotFound(rs.Error()) {
+			return "", ErrInvalidToken
+		}
+		return "", rs.Error()
+	}
+	if normaliseEmail(rs.ValueAsString()) != t.Email {
+		return "", ErrInvalidToken
+	}
+
+	rs = s.pdb.Command("HSET", profileKey(t.Pid), "emailverified", time.Now().Unix())
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	return t.Pid, nil
+}
+
+func (s *MemoryStore) indexEmail(pid PidType, email string) error {
+	email = normaliseEmail(email)
+	if email == "" {
+		return nil
+	}
+
+	if !s.pdb.hsetnx(EMAIL_PIDS, email, string(pid)) {
+		if owner, _ := s.pdb.hget(EMAIL_PIDS, email); PidType(owner) != pid {
+			return ErrEmailInUse
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) unindexEmail(pid PidType, email string) error {
+	email = normaliseEmail(email)
+	if owner, err := s.pdb.hget(EMAIL_PIDS, email); err == nil && PidType(owner) == pid {
+		s.pdb.hdel(EMAIL_PIDS, email)
+	}
+	return nil
+}
+
+func (s *MemoryStore) changeEmail(pid PidType, oldEmail string, newEmail string) error {
+	if normaliseEmail(oldEmail) == normaliseEmail(newEmail) {
+		return nil
+	}
+
+	s.unindexEmail(pid, oldEmail)
+	s.pdb.hdel(string(profileKey(pid)), "emailverified")
+	return nil
+}
+
+func (s *MemoryStore) RebuildEmailIndex() (int, error) {
+	n := 0
+
+	for _, pid := range s.profilePids() {
+		email, err := s.pdb.hget(string(profileKey(pid)), "email")
+		if err != nil || normaliseEmail(email) == "" {
+			continue
+		}
+		if s.indexEmail(pid, email) == nil {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) PidForEmail(email string) (PidType, error) {
+	pid, err := s.pdb.hget(EMAIL_PIDS, normaliseEmail(email))
+	return PidType(pid), err
+}
+
+func (s *MemoryStore) newAccountToken(kind string, t *accountToken, lifetime int) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	key := accountTokenKey(kind, token)
+	s.sdb.set(key, string(data))
+	s.sdb.expire(key, time.Duration(lifetime)*time.Second)
+
+	tokensKey := accountTokensKey(kind, t.Pid)
+	s.sdb.sadd(tokensKey, key)
+	s.sdb.expire(tokensKey, time.Duration(lifetime)*time.Second)
+
+	return token, nil
+}
+
+func (s *MemoryStore) revokeAccountTokens(kind string, pid PidType) {
+	tokensKey := accountTokensKey(kind, pid)
+	s.sdb.del(append(s.sdb.smembers(tokensKey), tokensKey)...)
+}
+
+func (s *MemoryStore) takeAccountToken(kind string, token string) (*accountToken, error) {
+	data, err := s.sdb.getdel(accountTokenKey(kind, token))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	return decodeAccountToken(data)
+}
+
+func (s *MemoryStore) PasswordResetToken(pid PidType) (string, error) {
+	if !s.pdb.exists(string(profileKey(pid))) {
+		return "", ErrKeyNotFound
+	}
+
+	return s.newAccountToken(tokenPasswordReset, &accountToken{Pid: pid}, s.config.Account.ResetLifetime)
+}
+
+func (s *MemoryStore) ResetPassword(token string, password string) (PidType, error) {
+	data, err := s.sdb.get(accountTokenKey(tokenPasswordReset, token))
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	t, err := decodeAccountToken(data)
+	if err != nil {
+		return "", err
+	}
+	if err := s.config.Passwords.Check(t.Pid, password); err != nil {
+		return "", err
+	}
+
+	if t, err = s.takeAccountToken(tokenPasswordReset, token); err != nil {
+		return "", err
+	}
+
+	if err := s.setPassword(t.Pid, password); err != nil {
+		return t.Pid, err
+	}
+
+	s.revokeAccountTokens(tokenPasswordReset, t.Pid)
+
+	if _, err := s.LogoutAll(t.Pid); err != nil {
+		return t.Pid, err
+	}
+
+	return t.Pid, s.UnlockLogin(t.Pid)
+}
+
+func (s *MemoryStore) EmailVerificationToken(pid PidType) (string, error) {
+	email, err := s.pdb.hget(string(profileKey(pid)), "email")
+	if err != nil {
+		return "", err
+	}
+	if email == "" {
+		return "", ErrNoEmail
+	}
+
+	return s.newAccountToken(tokenVerifyEmail, &accountToken{Pid: pid, Email: normaliseEmail(email)}, s.config.Account.VerifyLifetime)
+}
+
+func (s *MemoryStore) VerifyEmail(token string) (PidType, error) {
+	t, err := s.takeAccountToken(tokenVerifyEmail, token)
+	if err != nil {
+		return "", err
+	}
+
+	email, err := s.pdb.hget(string(profileKey(t.Pid)), "email")
+	if err != nil || normaliseEmail(email) != t.Email {
+		return "", ErrInvalidToken
+	}
+
+	s.pdb.hset(string(profileKey(t.Pid)), "emailverified", fmt.Sprintf("%d", time.Now().Unix()))
+	return t.Pid, nil
+}
@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func addTestProfileWithEmail(t *testing.T, s Store, pid PidType, email string) {
+	if err := s.AddProfile(pid, "secret", string(pid), "", "", "", "", email, "", "", "", "", ""); err != nil {
+		t.Fatalf("AddProfile(%s): %s", pid, err)
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+
+		first, err := s.PasswordResetToken("alice")
+		if err != nil {
+			t.Fatalf("PasswordResetToken: %s", err)
+		}
+		second, err := s.PasswordResetToken("alice")
+		if err != nil {
+			t.Fatalf("PasswordResetToken: %s", err)
+		}
+
+		if pid, err := s.ResetPassword(first, "new password"); err != nil || pid != "alice" {
+			t.Fatalf("ResetPassword = %s, %v", pid, err)
+		}
+		if ok, err := s.VerifyPassword("alice", "new password"); err != nil || !ok {
+			t.Errorf("VerifyPassword = %v, %v", ok, err)
+		}
+
+		// Using one token revokes the others
+		for _, token := range []string{first, second} {
+			if _, err := s.ResetPassword(token, "another password"); err != ErrInvalidToken {
+				t.Errorf("ResetPassword with a used token = %v, want %v", err, ErrInvalidToken)
+			}
+		}
+	})
+}
+
+// Forgets the email index, as for profiles added before it was maintained
+func clearTestEmailIndex(s Store) {
+	switch s := s.(type) {
+	case *RedisStore:
+		s.pdb.Command("DEL", EMAIL_PIDS)
+	case *MemoryStore:
+		s.pdb.del(EMAIL_PIDS)
+	}
+}
+
+func TestRebuildEmailIndex(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfileWithEmail(t, s, "alice", "Alice@Example.com")
+		addTestProfileWithEmail(t, s, "bob", "bob@example.com")
+		addTestProfile(t, s, "carol")
+		clearTestEmailIndex(s)
+
+		// Keys of other types that end in ":info" are skipped
+		if err := s.UpdateProfile("carol", map[string]string{"bio": "information"}); err != nil {
+			t.Fatalf("UpdateProfile: %s", err)
+		}
+		if err := s.AddSuggestedProfile("carol", "info"); err != nil {
+			t.Fatalf("AddSuggestedProfile: %s", err)
+		}
+
+		n, err := s.RebuildEmailIndex()
+		if err != nil || n != 2 {
+			t.Fatalf("RebuildEmailIndex = %d, %v, want 2", n, err)
+		}
+		if pid, err := s.PidForEmail("alice@example.com"); err != nil || pid != "alice" {
+			t.Errorf("PidForEmail = %s, %v, want alice", pid, err)
+		}
+		if err := s.AddProfile("dave", "secret", "dave", "", "", "", "", "bob@example.com", "", "", "", "", ""); err != ErrEmailInUse {
+			t.Errorf("AddProfile with bob's email = %v, want %v", err, ErrEmailInUse)
+		}
+	})
+}
+
+func TestAddProfileReleasesEmail(t *testing.T) {
+	s := newTestRedisStore(t)
+	defer s.Close()
+
+	// A key of the wrong type makes storing the profile fail
+	s.pdb.Command("SET", profileKey("alice"), "x")
+	if err := s.AddProfile("alice", "secret", "alice", "", "", "", "", "alice@example.com", "", "", "", "", ""); err == nil {
+		t.Fatalf("AddProfile succeeded over a string key")
+	}
+	if err := s.UpdateProfile("alice", map[string]string{"email": "carol@example.com"}); err == nil {
+		t.Fatalf("UpdateProfile succeeded over a string key")
+	}
+	s.pdb.Command("DEL", profileKey("alice"))
+
+	addTestProfileWithEmail(t, s, "bob", "alice@example.com")
+	addTestProfileWithEmail(t, s, "carol", "carol@example.com")
+}
@@ -0,0 +1,330 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// API tokens let ingest jobs and other clients act for a profile without its
+// password. Each token is a hash in the session database keyed, like
+// sessions, by the SHA-256 of the token so the token itself is never stored.
+// The tokens belonging to a pid are indexed by a set of their ids.
+
+// Scopes an API token can be granted
+const (
+	ScopeReadTimeline  = "timeline:read"
+	ScopeAddItem       = "item:add"
+	ScopePromote       = "item:promote"
+	ScopeManageFollows = "follows:manage"
+)
+
+var ApiTokenScopes = []string{ScopeReadTimeline, ScopeAddItem, ScopePromote, ScopeManageFollows}
+
+var (
+	ErrUnknownScope     = errors.New("datastore: unknown api token scope")
+	ErrApiTokenNameUsed = errors.New("datastore: api token name already used")
+)
+
+var apiTokenCodec = newHashCodec(ApiToken{})
+
+type ApiToken struct {
+	Id       string   `json:"id"`
+	Pid      PidType  `json:"pid" redis:"pid"`
+	Name     string   `json:"name" redis:"name"`
+	Scopes   []string `json:"scopes"`
+	Created  int64    `json:"created" redis:"created"`
+	LastUsed int64    `json:"lastused,omitempty" redis:"lastused"`
+	Expires  int64    `json:"expires,omitempty" redis:"expires"` // zero if the token doesn't expire
+}
+
+// HasScope reports whether the token was granted scope
+func (t *ApiToken) HasScope(scope string) bool {
+	return hasScope(t.Scopes, scope)
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func apiTokenKey(id string) string {
+	return fmt.Sprintf("apitoken:%s", id)
+}
+
+func apiTokensKey(pid PidType) string {
+	return fmt.Sprintf("apitokens:%s", pid)
+}
+
+func checkScopes(scopes []string) error {
+	for _, scope := range scopes {
+		if !hasScope(ApiTokenScopes, scope) {
+			return ErrUnknownScope
+		}
+	}
+	return nil
+}
+
+func apiTokenFromHash(id string, hash map[string]string) *ApiToken {
+	t := &ApiToken{Id: id}
+	apiTokenCodec.decode(hash, t)
+	t.Scopes = strings.Fields(hash["scopes"])
+	return t
+}
+
+func encodeApiToken(t *ApiToken) map[string]string {
+	hash := apiTokenCodec.encode(t)
+	hash["scopes"] = strings.Join(t.Scopes, " ")
+	return hash
+}
+
+// Stores a token unless pid has an unexpired token with the same name.
+// KEYS: token, pid's tokens
+// ARGV: id, name, expiry time or 0, then the token's fields and values
+var createApiTokenScript = newLuaScript(`
+for _, id in ipairs(redis.call('SMEMBERS', KEYS[2])) do
+	if redis.call('HGET', 'apitoken:' .. id, 'name') == ARGV[2] then
+		return 0
+	end
+end
+redis.call('HMSET', KEYS[1], unpack(ARGV, 4))
+if tonumber(ARGV[3]) > 0 then
+	redis.call('EXPIREAT', KEYS[1], ARGV[3])
+end
+redis.call('SADD', KEYS[2], ARGV[1])
+return 1
+`)
+
+// Reads a token and records when it was used, unless it has expired.
+// KEYS: token
+// ARGV: now
+var useApiTokenScript = newLuaScript(`
+if not redis.call('HGET', KEYS[1], 'pid') then
+	return false
+end
+local expires = tonumber(redis.call('HGET', KEYS[1], 'expires'))
+if expires and expires > 0 and expires <= tonumber(ARGV[1]) then
+	return false
+end
+local hash = redis.call('HGETALL', KEYS[1])
+redis.call('HSET', KEYS[1], 'lastused', ARGV[1])
+return hash
+`)
+
+type byApiTokenCreated []*ApiToken
+
+func (t byApiTokenCreated) Len() int           { return len(t) }
+func (t byApiTokenCreated) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+func (t byApiTokenCreated) Less(i, j int) bool { return t[i].Created < t[j].Created }
+
+// Makes a new token for pid with the given scopes, returning the token, which
+// can't be recovered later, and its description. The token expires after
+// lifetime, or never if lifetime is zero. Names must be unique for each pid.
+func (s *RedisStore) CreateApiToken(pid PidType, name string, scopes []string, lifetime time.Duration) (string, *ApiToken, error) {
+	if err := checkScopes(scopes); err != nil {
+		return "", nil, err
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	t := &ApiToken{Id: tokenId(token), Pid: pid, Name: name, Scopes: scopes, Created: time.Now().Unix()}
+	if lifetime > 0 {
+		t.Expires = time.Now().Add(lifetime).Unix()
+	}
+
+	// The name is checked and the token stored in one step so that
+	// concurrent requests can't both use a name
+	args := []interface{}{t.Id, t.Name, t.Expires}
+	for k, v := range encodeApiToken(t) {
+		args = append(args, k, v)
+	}
+	rs := createApiTokenScript.run(s.sdb, []string{apiTokenKey(t.Id), apiTokensKey(pid)}, args...)
+	if !rs.IsOK() {
+		return "", nil, rs.Error()
+	}
+	if created, _ := rs.ValueAsBool(); !created {
+		return "", nil, ErrApiTokenNameUsed
+	}
+
+	return token, t, nil
+}
+
+// Lists the unexpired tokens belonging to pid, oldest first
+func (s *RedisStore) ApiTokens(pid PidType) ([]*ApiToken, error) {
+	tokens := make([]*ApiToken, 0)
+
+	rs := s.sdb.Command("SMEMBERS", apiTokensKey(pid))
+	if !rs.IsOK() {
+		return tokens, rs.Error()
+	}
+
+	for _, id := range rs.ValuesAsStrings() {
+		rs := s.sdb.Command("HGETALL", apiTokenKey(id))
+		if !rs.IsOK() {
+			return tokens, rs.Error()
+		}
+
+		hash := valuesToHash(rs.ValuesAsStrings())
+		if hash["pid"] == "" {
+			// Expired
+			s.sdb.Command("SREM", apiTokensKey(pid), id)
+			continue
+		}
+
+		tokens = append(tokens, apiTokenFromHash(id, hash))
+	}
+
+	sort.Sort(byApiTokenCreated(tokens))
+	return tokens, nil
+}
+
+// Revokes the token with the given id if it belongs to pid
+func (s *RedisStore) RevokeApiToken(pid PidType, id string) error {
+	rs := s.sdb.Command("HGET", apiTokenKey(id), "pid")
+	if rs.IsOK() && PidType(rs.ValueAsString()) == pid {
+		rs = s.sdb.Command("DEL", apiTokenKey(id))
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+	}
+
+	rs = s.sdb.Command("SREM", apiTokensKey(pid), id)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// Revokes every token belonging to pid, returning the number revoked
+func (s *RedisStore) revokeApiTokens(pid PidType) (int, error) {
+	tokens, err := s.ApiTokens(pid)
+	if err != nil {
+		return 0, err
+	}
+
+	for i, t := range tokens {
+		if err := s.RevokeApiToken(pid, t.Id); err != nil {
+			return i, err
+		}
+	}
+
+	rs := s.sdb.Command("DEL", apiTokensKey(pid))
+	if !rs.IsOK() {
+		return len(tokens), rs.Error()
+	}
+
+	return len(tokens), nil
+}
+
+// Checks an API token, returning the pid it acts for and the scopes it was
+// granted. Returns ErrInvalidToken if the token doesn't exist, has been
+// revoked or has expired. Records when the token was last used.
+func (s *RedisStore) ValidateApiToken(token string) (PidType, []string, error) {
+	id := tokenId(token)
+
+	rs := useApiTokenScript.run(s.sdb, []string{apiTokenKey(id)}, time.Now().Unix())
+	if !rs.IsOK() {
+		if isKeyNotFound(rs.Error()) {
+			return "", nil, ErrInvalidToken
+		}
+		return "", nil, rs.Error()
+	}
+
+	t := apiTokenFromHash(id, valuesToHash(rs.ValuesAsStrings()))
+	if t.Pid == "" {
+		return "", nil, ErrInvalidToken
+	}
+
+	return t.Pid, t.Scopes, nil
+}
+
+func (s *MemoryStore) CreateApiToken(pid PidType, name string, scopes []string, lifetime time.Duration) (string, *ApiToken, error) {
+	if err := checkScopes(scopes); err != nil {
+		return "", nil, err
+	}
+
+	existing, _ := s.ApiTokens(pid)
+	for _, t := range existing {
+		if t.Name == name {
+			return "", nil, ErrApiTokenNameUsed
+		}
+	}
+
+	token, err := newSessionToken()
+	if err != nil {
+		return "", nil, err
+	}
+
+	t := &ApiToken{Id: tokenId(token), Pid: pid, Name: name, Scopes: scopes, Created: time.Now().Unix()}
+	if lifetime > 0 {
+		t.Expires = time.Now().Add(lifetime).Unix()
+	}
+
+	s.sdb.hmset(apiTokenKey(t.Id), encodeApiToken(t))
+	if lifetime > 0 {
+		s.sdb.expire(apiTokenKey(t.Id), lifetime)
+	}
+	s.sdb.sadd(apiTokensKey(pid), t.Id)
+
+	return token, t, nil
+}
+
+func (s *MemoryStore) ApiTokens(pid PidType) ([]*ApiToken, error) {
+	tokens := make([]*ApiToken, 0)
+
+	for _, id := range s.sdb.smembers(apiTokensKey(pid)) {
+		hash := s.sdb.hgetall(apiTokenKey(id))
+		if hash["pid"] == "" {
+			s.sdb.srem(apiTokensKey(pid), id)
+			continue
+		}
+		tokens = append(tokens, apiTokenFromHash(id, hash))
+	}
+
+	sort.Sort(byApiTokenCreated(tokens))
+	return tokens, nil
+}
+
+func (s *MemoryStore) RevokeApiToken(pid PidType, id string) error {
+	if owner, err := s.sdb.hget(apiTokenKey(id), "pid"); err == nil && PidType(owner) == pid {
+		s.sdb.del(apiTokenKey(id))
+	}
+	s.sdb.srem(apiTokensKey(pid), id)
+	return nil
+}
+
+func (s *MemoryStore) revokeApiTokens(pid PidType) (int, error) {
+	tokens, _ := s.ApiTokens(pid)
+	for _, t := range tokens {
+		s.RevokeApiToken(pid, t.Id)
+	}
+	s.sdb.del(apiTokensKey(pid))
+	return len(tokens), nil
+}
+
+func (s *MemoryStore) ValidateApiToken(token string) (PidType, []string, error) {
+	id := tokenId(token)
+
+	hash := s.sdb.hgetall(apiTokenKey(id))
+	if hash["pid"] == "" {
+		return "", nil, ErrInvalidToken
+	}
+
+	t := apiTokenFromHash(id, hash)
+	if t.Expires > 0 && t.Expires <= time.Now().Unix() {
+		return "", nil, ErrInvalidToken
+	}
+
+	s.sdb.hset(apiTokenKey(id), "lastused", fmt.Sprintf("%d", time.Now().Unix()))
+	return t.Pid, t.Scopes, nil
+}
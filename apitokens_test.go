@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestApiTokens(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+
+		token, created, err := s.CreateApiToken("alice", "ingest", []string{ScopeAddItem}, time.Hour)
+		if err != nil {
+			t.Fatalf("CreateApiToken: %s", err)
+		}
+		if created.Id != tokenId(token) || created.Id == token {
+			t.Errorf("token stored under %s", created.Id)
+		}
+
+		pid, scopes, err := s.ValidateApiToken(token)
+		if err != nil || pid != "alice" || len(scopes) != 1 || scopes[0] != ScopeAddItem {
+			t.Fatalf("ValidateApiToken = %s, %v, %v", pid, scopes, err)
+		}
+
+		tokens, err := s.ApiTokens("alice")
+		if err != nil || len(tokens) != 1 || tokens[0].LastUsed == 0 {
+			t.Fatalf("ApiTokens = %v, %v, want one used token", tokens, err)
+		}
+
+		if _, _, err := s.CreateApiToken("alice", "ingest", nil, 0); err != ErrApiTokenNameUsed {
+			t.Errorf("CreateApiToken with a used name = %v, want %v", err, ErrApiTokenNameUsed)
+		}
+
+		if err := s.RevokeApiToken("alice", created.Id); err != nil {
+			t.Fatalf("RevokeApiToken: %s", err)
+		}
+		if _, _, err := s.ValidateApiToken(token); err != ErrInvalidToken {
+			t.Errorf("ValidateApiToken after revoking = %v, want %v", err, ErrInvalidToken)
+		}
+		if _, _, err := s.ValidateApiToken("12345"); err != ErrInvalidToken {
+			t.Errorf("ValidateApiToken of an unknown token = %v, want %v", err, ErrInvalidToken)
+		}
+	})
+}
+
+func TestCreateApiTokenConcurrent(t *testing.T) {
+	s := newTestRedisStore(t)
+	defer s.Close()
+
+	addTestProfile(t, s, "alice")
+
+	// Only one of the tokens with each name is created
+	const names = 4
+	created := make(chan string, names*8)
+	concurrently(t, names*8, func(i int) error {
+		name := fmt.Sprintf("token%d", i%names)
+		_, _, err := s.CreateApiToken("alice", name, nil, 0)
+		if err == ErrApiTokenNameUsed {
+			return nil
+		}
+		if err == nil {
+			created <- name
+		}
+		return err
+	})
+	close(created)
+
+	if len(created) != names {
+		t.Errorf("%d tokens created, want %d", len(created), names)
+	}
+	if tokens, err := s.ApiTokens("alice"); err != nil || len(tokens) != names {
+		t.Errorf("ApiTokens = %d, %v, want %d", len(tokens), err, names)
+	}
+}
@@ -0,0 +1,355 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"code.google.com/p/tcgl/redis"
+	"strings"
+)
+
+// Kinds of inconsistency found by Check
+const (
+	CheckMissingItem       = "timeline entry refers to a missing item"
+	CheckMissingSource     = "possibly timeline entry has no recorded source"
+	CheckOrphanedSource    = "source recorded for an item not in the timeline"
+	CheckOneSidedFollowing = "following entry without matching followers entry"
+	CheckOneSidedFollower  = "followers entry without matching following entry"
+	CheckMissingProfile    = "set refers to a missing profile"
+	CheckOrphanedSession   = "session belongs to a missing profile"
+	CheckMissingImageItem  = "item needing an image is missing"
+
+	checkMaxExamples = 10
+	checkBatchSize   = 100
+)
+
+type Inconsistency struct {
+	Kind     string   `json:"kind"`
+	Count    int      `json:"count"`
+	Repaired int      `json:"repaired"`
+	Examples []string `json:"examples"`
+}
+
+type CheckReport struct {
+	Inconsistencies []*Inconsistency `json:"inconsistencies"`
+}
+
+// Returns the inconsistency of the given kind, adding it to the report if needed
+func (r *CheckReport) kind(kind string) *Inconsistency {
+	for _, inc := range r.Inconsistencies {
+		if inc.Kind == kind {
+			return inc
+		}
+	}
+	inc := &Inconsistency{Kind: kind, Examples: make([]string, 0)}
+	r.Inconsistencies = append(r.Inconsistencies, inc)
+	return inc
+}
+
+func (r *CheckReport) add(kind string, example string, repaired bool) {
+	inc := r.kind(kind)
+	inc.Count++
+	if repaired {
+		inc.Repaired++
+	}
+	if len(inc.Examples) < checkMaxExamples {
+		inc.Examples = append(inc.Examples, example)
+	}
+}
+
+// Reports whether any inconsistencies were found
+func (r *CheckReport) Clean() bool {
+	return len(r.Inconsistencies) == 0
+}
+
+// checker holds the state of a single run of Check
+type checker struct {
+	s        *RedisStore
+	repair   bool
+	report   *CheckReport
+	profiles map[PidType]bool
+}
+
+// Check scans all four databases for references that don't resolve, such as
+// timeline entries for deleted items or one sided follow relationships. When
+// repair is true each inconsistency is fixed by removing the dangling
+// reference, except for one sided follows which are only reported since it
+// can't be told whether the follow was being made or undone. Keys are found
+// with SCAN, so keys added while Check runs may not be checked.
+func (s *RedisStore) Check(repair bool) (*CheckReport, error) {
+	c := &checker{
+		s:        s,
+		repair:   repair,
+		report:   &CheckReport{Inconsistencies: make([]*Inconsistency, 0)},
+		profiles: make(map[PidType]bool),
+	}
+
+	for _, check := range []func() error{c.checkTimelines, c.checkSources, c.checkFollows, c.checkProfileSets, c.checkSessions, c.checkItemsNeedingImages} {
+		if err := check(); err != nil {
+			return c.report, err
+		}
+	}
+
+	return c.report, nil
+}
+
+func (c *checker) keys(db *redis.Database, pattern string) ([]string, error) {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+
+	err := scanKeys(db, pattern, func(batch []string) error {
+		for _, key := range batch {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+
+	return keys, err
+}
+
+func (c *checker) profileExists(pid PidType) bool {
+	exists, seen := c.profiles[pid]
+	if !seen {
+		exists = keyExists(c.s.pdb, string(profileKey(pid)))
+		c.profiles[pid] = exists
+	}
+	return exists
+}
+
+// Applies a repair command, logging rather than failing the check if it can't be applied
+func (c *checker) fix(db *redis.Database, cmd string, args ...interface{}) bool {
+	if !c.repair {
+		return false
+	}
+	rs := db.Command(cmd, args...)
+	if !rs.IsOK() {
+		applog.Errorf("Could not repair inconsistency with %s %v: %s", cmd, args, rs.Error().Error())
+		return false
+	}
+	return true
+}
+
+// Finds timeline entries whose item no longer exists and possibly entries
+// with no recorded source
+func (c *checker) checkTimelines() error {
+	for _, pattern := range []string{"*:possibly:" + ORDERING_TS, "*:maybe:" + ORDERING_TS} {
+		timelineKeys, err := c.keys(c.s.tdb, pattern)
+		if err != nil {
+			return err
+		}
+
+		for _, timelineKey := range timelineKeys {
+			rs := c.s.tdb.Command("ZRANGE", timelineKey, 0, -1)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+			itemKeys := rs.ValuesAsStrings()
+			possibly := strings.Contains(timelineKey, ":possibly:")
+			pid := PidType(timelineKey[:strings.Index(timelineKey, ":")])
+
+			for start := 0; start < len(itemKeys); start += checkBatchSize {
+				end := start + checkBatchSize
+				if end > len(itemKeys) {
+					end = len(itemKeys)
+				}
+				batch := make([]interface{}, 0, end-start)
+				for _, itemKey := range itemKeys[start:end] {
+					batch = append(batch, itemKey)
+				}
+
+				rs = c.s.idb.Command("MGET", batch...)
+				if !rs.IsOK() {
+					return rs.Error()
+				}
+				items := rs.ValuesAsStrings()
+
+				var sources []string
+				if possibly {
+					rs = c.s.tdb.Command("HMGET", append([]interface{}{sourcesKey(pid)}, batch...)...)
+					if !rs.IsOK() {
+						return rs.Error()
+					}
+					sources = rs.ValuesAsStrings()
+				}
+
+				for i, itemKey := range itemKeys[start:end] {
+					example := timelineKey + " " + itemKey
+					if i >= len(items) || items[i] == "" {
+						repaired := c.fix(c.s.tdb, "ZREM", timelineKey, itemKey)
+						if possibly {
+							c.fix(c.s.tdb, "HDEL", sourcesKey(pid), itemKey)
+						}
+						c.report.add(CheckMissingItem, example, repaired)
+					} else if possibly && (i >= len(sources) || sources[i] == "") {
+						// Without a source the entry could never be removed by an unfollow or demote
+						c.report.add(CheckMissingSource, example, c.fix(c.s.tdb, "ZREM", timelineKey, itemKey))
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Finds recorded sources for items that are no longer in the possibly timeline
+func (c *checker) checkSources() error {
+	sourceKeys, err := c.keys(c.s.tdb, "*:sources")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range sourceKeys {
+		pid := PidType(strings.TrimSuffix(key, ":sources"))
+		timelineKey := possiblyKey(pid, ORDERING_TS)
+
+		rs := c.s.tdb.Command("HKEYS", key)
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+
+		for _, itemKey := range rs.ValuesAsStrings() {
+			rs = c.s.tdb.Command("ZSCORE", timelineKey, itemKey)
+			if rs.IsOK() {
+				continue
+			}
+			if !isKeyNotFound(rs.Error()) {
+				return rs.Error()
+			}
+			c.report.add(CheckOrphanedSource, key+" "+itemKey, c.fix(c.s.tdb, "HDEL", key, itemKey))
+		}
+	}
+
+	return nil
+}
+
+// Finds follow relationships recorded on only one side or involving a
+// missing profile
+func (c *checker) checkFollows() error {
+	sides := []struct {
+		suffix  string
+		inverse func(PidType) string
+		kind    string
+	}{
+		{":following", followersKey, CheckOneSidedFollowing},
+		{":followers", followingKey, CheckOneSidedFollower},
+	}
+
+	for _, side := range sides {
+		keys, err := c.keys(c.s.pdb, "*"+side.suffix)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			pid := PidType(strings.TrimSuffix(key, side.suffix))
+
+			rs := c.s.pdb.Command("ZRANGE", key, 0, -1)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+
+			for _, other := range rs.ValuesAsStrings() {
+				example := key + " " + other
+
+				if !c.profileExists(pid) || !c.profileExists(PidType(other)) {
+					c.report.add(CheckMissingProfile, example, c.fix(c.s.pdb, "ZREM", key, other))
+					continue
+				}
+
+				rs = c.s.pdb.Command("ZSCORE", side.inverse(PidType(other)), pid)
+				if rs.IsOK() {
+					continue
+				}
+				if !isKeyNotFound(rs.Error()) {
+					return rs.Error()
+				}
+				c.report.add(side.kind, example, false)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Finds members of profile sets that refer to deleted profiles
+func (c *checker) checkProfileSets() error {
+	setKeys, err := c.keys(c.s.pdb, feedsKey("*"))
+	if err != nil {
+		return err
+	}
+
+	suggestedKeys, err := c.keys(c.s.pdb, suggestedProfileKey("*"))
+	if err != nil {
+		return err
+	}
+
+	setKeys = append(setKeys, suggestedKeys...)
+	setKeys = append(setKeys, FEED_DRIVEN_PROFILES)
+
+	for _, key := range setKeys {
+		rs := c.s.pdb.Command("SMEMBERS", key)
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+
+		for _, pid := range rs.ValuesAsStrings() {
+			if !c.profileExists(PidType(pid)) {
+				c.report.add(CheckMissingProfile, key+" "+pid, c.fix(c.s.pdb, "SREM", key, pid))
+			}
+		}
+	}
+
+	rs := c.s.pdb.Command("ZRANGE", FLAGGED_PROFILES, 0, -1)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	for _, pid := range rs.ValuesAsStrings() {
+		if !c.profileExists(PidType(pid)) {
+			c.report.add(CheckMissingProfile, FLAGGED_PROFILES+" "+pid, c.fix(c.s.pdb, "ZREM", FLAGGED_PROFILES, pid))
+		}
+	}
+
+	return nil
+}
+
+// Finds sessions belonging to deleted profiles
+func (c *checker) checkSessions() error {
+	keys, err := c.keys(c.s.sdb, "session:*")
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		rs := c.s.sdb.Command("GET", key)
+		if !rs.IsOK() {
+			if isKeyNotFound(rs.Error()) {
+				continue
+			}
+			return rs.Error()
+		}
+
+		if pid := PidType(rs.ValueAsString()); !c.profileExists(pid) {
+			c.report.add(CheckOrphanedSession, key+" "+string(pid), c.fix(c.s.sdb, "DEL", key))
+		}
+	}
+
+	return nil
+}
+
+// Finds queued image requests for items that no longer exist
+func (c *checker) checkItemsNeedingImages() error {
+	rs := c.s.pdb.Command("SMEMBERS", ITEMS_NEEDING_IMAGES)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	for _, id := range rs.ValuesAsStrings() {
+		if !keyExists(c.s.idb, ItemKey(ItemIdType(id))) {
+			c.report.add(CheckMissingImageItem, id, c.fix(c.s.pdb, "SREM", ITEMS_NEEDING_IMAGES, id))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,63 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func checkCount(report *CheckReport, kind string) (count int, repaired int) {
+	for _, inc := range report.Inconsistencies {
+		if inc.Kind == kind {
+			return inc.Count, inc.Repaired
+		}
+	}
+	return 0, 0
+}
+
+func TestCheck(t *testing.T) {
+	s := newTestRedisStore(t)
+	defer s.Close()
+
+	addTestProfile(t, s, "alice")
+	addTestProfile(t, s, "bob")
+	addTestItem(t, s, "alice", "hello")
+
+	// More timelines than are read by one SCAN, each with a missing item
+	timelines := scanBatchSize + scanBatchSize/2
+	for i := 0; i < timelines; i++ {
+		rs := s.tdb.Command("ZADD", maybeKey(PidType(fmt.Sprintf("reader%d", i)), ORDERING_TS), 1, ItemKey("missing"))
+		if !rs.IsOK() {
+			t.Fatalf("ZADD: %s", rs.Error())
+		}
+	}
+
+	// bob follows alice, but only one side was recorded
+	s.pdb.Command("ZADD", followingKey("bob"), 1, "alice")
+
+	report, err := s.Check(true)
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+
+	if count, repaired := checkCount(report, CheckMissingItem); count != timelines || repaired != timelines {
+		t.Errorf("%d missing items found and %d repaired, want %d", count, repaired, timelines)
+	}
+
+	if count, repaired := checkCount(report, CheckOneSidedFollowing); count != 1 || repaired != 0 {
+		t.Errorf("%d one sided follows found and %d repaired, want 1 and 0", count, repaired)
+	}
+	if rs := s.pdb.Command("ZSCORE", followingKey("bob"), "alice"); !rs.IsOK() {
+		t.Errorf("one sided follow was removed: %s", rs.Error())
+	}
+
+	report, err = s.Check(false)
+	if err != nil {
+		t.Fatalf("Check: %s", err)
+	}
+	if count, _ := checkCount(report, CheckMissingItem); count != 0 {
+		t.Errorf("%d missing items found after repair", count)
+	}
+	if len(report.Inconsistencies) != 1 {
+		t.Errorf("inconsistencies after repair = %v", report.Inconsistencies)
+	}
+}
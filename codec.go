@@ -0,0 +1,185 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Struct fields tagged redis:"field" are stored in a hash under that field
+// name. Fields tagged redis:"field,writable" may also be changed through
+// UpdateProfile. Fields tagged redis:"field,writeonly" are stored but never
+// read back, for secrets that are only checked in the database.
+
+var (
+	profileCodec      = newHashCodec(Profile{})
+	briefProfileCodec = newHashCodec(BriefProfile{})
+)
+
+var (
+	ProfileProperties = profileCodec.writableFields()
+)
+
+// ProfileFieldError is returned by UpdateProfile when asked to change a field
+// that doesn't exist or can't be changed
+type ProfileFieldError struct {
+	Field    string
+	Unknown  bool
+	Readonly bool
+}
+
+func (e *ProfileFieldError) Error() string {
+	if e.Unknown {
+		return fmt.Sprintf("datastore: unknown profile field %q", e.Field)
+	}
+	return fmt.Sprintf("datastore: profile field %q is not writable", e.Field)
+}
+
+type hashField struct {
+	name      string
+	index     int
+	kind      reflect.Kind
+	writable  bool
+	writeonly bool
+}
+
+type hashCodec struct {
+	fields []hashField
+	byName map[string]*hashField
+}
+
+func newHashCodec(v interface{}) *hashCodec {
+	t := reflect.TypeOf(v)
+	c := &hashCodec{byName: make(map[string]*hashField)}
+
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("redis")
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		parts := strings.Split(tag, ",")
+		f := hashField{name: parts[0], index: i, kind: t.Field(i).Type.Kind()}
+		for _, opt := range parts[1:] {
+			switch opt {
+			case "writable":
+				f.writable = true
+			case "writeonly":
+				f.writeonly = true
+			}
+		}
+
+		switch {
+		case f.kind == reflect.String, f.kind == reflect.Int, f.kind == reflect.Int64:
+		case f.kind == reflect.Slice && t.Field(i).Type.Elem().Kind() == reflect.Uint8:
+		default:
+			panic(fmt.Sprintf("datastore: can't store %s field %s in a hash", t.Field(i).Type, t.Field(i).Name))
+		}
+
+		c.fields = append(c.fields, f)
+	}
+
+	for i := range c.fields {
+		c.byName[c.fields[i].name] = &c.fields[i]
+	}
+
+	return c
+}
+
+// The names of every field in the hash that can be read
+func (c *hashCodec) names() []string {
+	names := make([]string, 0, len(c.fields))
+	for _, f := range c.fields {
+		if !f.writeonly {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+func (c *hashCodec) writableFields() []string {
+	names := make([]string, 0, len(c.fields))
+	for _, f := range c.fields {
+		if f.writable {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// Encodes the tagged fields of the struct pointed to by v
+func (c *hashCodec) encode(v interface{}) map[string]string {
+	rv := reflect.ValueOf(v).Elem()
+	hash := make(map[string]string, len(c.fields))
+
+	for _, f := range c.fields {
+		fv := rv.Field(f.index)
+		switch fv.Kind() {
+		case reflect.String:
+			hash[f.name] = fv.String()
+		case reflect.Int, reflect.Int64:
+			hash[f.name] = strconv.FormatInt(fv.Int(), 10)
+		case reflect.Slice:
+			hash[f.name] = string(fv.Bytes())
+		}
+	}
+
+	return hash
+}
+
+// Decodes hash into the struct pointed to by v. Fields that aren't in the
+// hash, can't be parsed or are write only are left unchanged.
+func (c *hashCodec) decode(hash map[string]string, v interface{}) {
+	rv := reflect.ValueOf(v).Elem()
+
+	for k, val := range hash {
+		f, exists := c.byName[k]
+		if !exists || f.writeonly {
+			continue
+		}
+
+		fv := rv.Field(f.index)
+		switch fv.Kind() {
+		case reflect.String:
+			fv.SetString(val)
+		case reflect.Int, reflect.Int64:
+			if n, err := strconv.ParseInt(val, 10, 64); err == nil {
+				fv.SetInt(n)
+			}
+		case reflect.Slice:
+			fv.SetBytes([]byte(val))
+		}
+	}
+}
+
+// Decodes values returned by HMGET for the fields listed by names
+func (c *hashCodec) decodeValues(vals []string, v interface{}) {
+	hash := make(map[string]string, len(vals))
+	for i, name := range c.names() {
+		if i < len(vals) {
+			hash[name] = vals[i]
+		}
+	}
+	c.decode(hash, v)
+}
+
+// Checks that every key in values names a writable field that can hold its
+// value
+func (c *hashCodec) validate(values map[string]string) error {
+	for k, val := range values {
+		f, exists := c.byName[k]
+		if !exists {
+			return &ProfileFieldError{Field: k, Unknown: true}
+		}
+		if !f.writable {
+			return &ProfileFieldError{Field: k, Readonly: true}
+		}
+		if f.kind == reflect.Int || f.kind == reflect.Int64 {
+			if _, err := strconv.ParseInt(val, 10, 64); err != nil {
+				return fmt.Errorf("datastore: profile field %q must be an integer", k)
+			}
+		}
+	}
+	return nil
+}
@@ -8,10 +8,19 @@ const (
 )
 
 type Config struct {
-	Profile  RedisConfig
-	Timeline RedisConfig
-	Item     RedisConfig
-	Session  RedisConfig
+	Profile   RedisConfig
+	Timeline  RedisConfig
+	Item      RedisConfig
+	Session   RedisConfig
+	Sessions  SessionConfig
+	Passwords PasswordConfig
+	Login     LoginConfig
+	Account   AccountConfig
+	OAuth     OAuthConfig
+	Images    ImageConfig
+	Imager    ImagerConfig
+	Fetch     FetchConfig
+	Fanout    FanoutConfig
 }
 
 type RedisConfig struct {
@@ -21,6 +30,108 @@ type RedisConfig struct {
 	PoolSize int    `toml:"poolsize"`
 }
 
+type SessionConfig struct {
+	Lifetime int `toml:"lifetime"` // seconds since the session was last used
+}
+
+// PasswordConfig sets the cost of new password hashes and the policy new
+// passwords must meet
+type PasswordConfig struct {
+	Cost      int      `toml:"cost"` // bcrypt cost
+	MinLength int      `toml:"minlength"`
+	Deny      []string `toml:"deny"` // passwords that may not be used, ignoring case
+}
+
+// LoginConfig sets how failed logins are throttled
+type LoginConfig struct {
+	MaxFailures int `toml:"maxfailures"` // failures before logins are locked, negative to never lock
+	Lockout     int `toml:"lockout"`     // seconds locked after MaxFailures, doubled after each further failure, negative to never lock
+	MaxLockout  int `toml:"maxlockout"`  // seconds
+	Window      int `toml:"window"`      // seconds a failure is remembered for
+}
+
+// AccountConfig sets the lifetimes of password reset and email verification
+// tokens
+type AccountConfig struct {
+	ResetLifetime  int `toml:"resetlifetime"`  // seconds
+	VerifyLifetime int `toml:"verifylifetime"` // seconds
+}
+
+type OAuthConfig struct {
+	StateLifetime int `toml:"statelifetime"` // seconds
+}
+
+type ImageConfig struct {
+	// The first variant is used as an item's main image
+	Variants  []ImageVariant `toml:"variants"`
+	Types     []string       `toml:"types"`     // media types accepted for remote images
+	MaxPixels int            `toml:"maxpixels"` // largest width times height decoded
+
+	// Keep animated GIFs unchanged as an extra variant alongside the crops
+	KeepAnimated bool `toml:"keepanimated"`
+}
+
+type FetchConfig struct {
+	Timeout      int   `toml:"timeout"` // seconds
+	MaxBytes     int64 `toml:"maxbytes"`
+	MaxRedirects int   `toml:"maxredirects"`
+	AllowPrivate bool  `toml:"allowprivate"` // allow fetching from private and loopback addresses
+}
+
+type FanoutConfig struct {
+	// Leave queued changes to followers' timelines to workers in other
+	// processes rather than starting them in NewRedisStore
+	NoWorkers bool `toml:"noworkers"`
+}
+
+type ImagerConfig struct {
+	Workers      int `toml:"workers"`
+	Attempts     int `toml:"attempts"`
+	Lease        int `toml:"lease"`        // seconds an item is claimed for
+	HostInterval int `toml:"hostinterval"` // minimum milliseconds between requests to a host
+}
+
+// Fills in settings left at zero from DefaultConfig where zero would break
+// the store. Redis rejects a zero expiry and deletes a key given one by
+// EXPIRE, and image workers need at least one worker, attempt and second of
+// lease. Leaving login throttling unset doesn't turn it off; that takes a
+// negative MaxFailures or Lockout.
+func (c Config) withDefaults() Config {
+	if c.Login.MaxFailures == 0 {
+		c.Login.MaxFailures = DefaultConfig.Login.MaxFailures
+	}
+	if c.Login.Lockout == 0 {
+		c.Login.Lockout = DefaultConfig.Login.Lockout
+	}
+	if c.Login.Window <= 0 {
+		c.Login.Window = DefaultConfig.Login.Window
+	}
+	if c.Sessions.Lifetime <= 0 {
+		c.Sessions.Lifetime = DefaultConfig.Sessions.Lifetime
+	}
+	if c.Account.ResetLifetime <= 0 {
+		c.Account.ResetLifetime = DefaultConfig.Account.ResetLifetime
+	}
+	if c.Account.VerifyLifetime <= 0 {
+		c.Account.VerifyLifetime = DefaultConfig.Account.VerifyLifetime
+	}
+	if c.OAuth.StateLifetime <= 0 {
+		c.OAuth.StateLifetime = DefaultConfig.OAuth.StateLifetime
+	}
+	if c.Imager.Workers <= 0 {
+		c.Imager.Workers = DefaultConfig.Imager.Workers
+	}
+	if c.Imager.Attempts <= 0 {
+		c.Imager.Attempts = DefaultConfig.Imager.Attempts
+	}
+	if c.Imager.Lease <= 0 {
+		c.Imager.Lease = DefaultConfig.Imager.Lease
+	}
+	return c
+}
+
+var BannerVariant = ImageVariant{Name: "banner", Width: 460, Height: 160, Crop: CropSalience, Format: FormatPNG}
+
 var DefaultConfig Config = Config{
 	Profile: RedisConfig{
 		Database: 0,
@@ -42,4 +153,45 @@ var DefaultConfig Config = Config{
 		Address:  "localhost:6379",
 		PoolSize: 20,
 	},
+	Sessions: SessionConfig{
+		Lifetime: 30 * 24 * 60 * 60,
+	},
+	Passwords: PasswordConfig{
+		Cost:      10,
+		MinLength: 8,
+		Deny:      []string{"password", "password1", "12345678", "123456789", "qwertyuiop", "letmein1", "iloveyou", "placetime"},
+	},
+	Login: LoginConfig{
+		MaxFailures: 5,
+		Lockout:     60,
+		MaxLockout:  60 * 60,
+		Window:      24 * 60 * 60,
+	},
+	Account: AccountConfig{
+		ResetLifetime:  60 * 60,
+		VerifyLifetime: 7 * 24 * 60 * 60,
+	},
+	OAuth: OAuthConfig{
+		StateLifetime: 600,
+	},
+	Images: ImageConfig{
+		Variants: []ImageVariant{
+			BannerVariant,
+			{Name: "thumbnail", Width: 240, Height: 135, Crop: CropCentre, Format: FormatJPEG, Quality: 80},
+			{Name: "square", Width: 128, Height: 128, Crop: CropSalience, Format: FormatJPEG, Quality: 85},
+		},
+		Types:     []string{"image/jpeg", "image/png", "image/gif", "image/webp"},
+		MaxPixels: 40000000,
+	},
+	Imager: ImagerConfig{
+		Workers:      4,
+		Attempts:     5,
+		Lease:        300,
+		HostInterval: 1000,
+	},
+	Fetch: FetchConfig{
+		Timeout:      10,
+		MaxBytes:     10 << 20,
+		MaxRedirects: 5,
+	},
 }
@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"time"
+)
+
+// Store is the set of operations supported by every datastore backend
+type Store interface {
+	Close()
+	ResetAll() error
+
+	// Profiles
+	Profile(pid PidType) (*Profile, error)
+	BriefProfile(pid PidType) (*BriefProfile, error)
+	ProfileExists(pid PidType) (bool, error)
+	AddProfile(pid PidType, password string, pname string, bio string, feedtype string, feedurl string, parentpid PidType, email string, location string, url string, profileImageUrl string, profileImageUrlHttps string, itemType string) error
+	UpdateProfile(pid PidType, values map[string]string) error
+	RemoveProfile(pid PidType) error
+	DeleteProfile(pid PidType) (*ProfileDeletion, error)
+	ResumeProfileDeletions() ([]*ProfileDeletion, error)
+	RebuildDeletionIndexes() (int, error)
+	FlagProfile(pid PidType) error
+	FlaggedProfiles(start int, count int) ([]*ScoredProfile, error)
+	FeedDrivenProfiles() ([]*Profile, error)
+	Feeds(pid PidType) ([]*Profile, error)
+	SuggestedProfiles(loc string) ([]*Profile, error)
+	AddSuggestedProfile(pid PidType, loc string) error
+	RemoveSuggestedProfile(pid PidType, loc string) error
+	FindProfilesBySubstring(srch string) ([]*Profile, error)
+	SearchProfiles(query string, start int, count int) ([]*Profile, error)
+	AutocompleteProfiles(query string, count int) ([]*BriefProfile, error)
+	RebuildSearchIndex() (int, error)
+
+	// Items
+	Item(id ItemIdType) (*Item, error)
+	ItemByKey(itemKey string) (*Item, error)
+	ItemExists(id ItemIdType) (bool, error)
+	AddItem(pid PidType, ets time.Time, text string, link string, image string, itemid ItemIdType, media string, duration int) (ItemIdType, error)
+	SaveItem(item *Item, lifetime int) (string, error)
+	UpdateItem(item *Item) error
+	EditItem(item *Item) error
+	DeleteItem(id ItemIdType) error
+	RebuildPromotersIndex() (int, error)
+	GrabItemsNeedingImages(max int) ([]*Item, error)
+	ImageFromLink(item *Item) error
+
+	// Timelines
+	TimelineRange(pid PidType, status string, ts time.Time, before int, after int) ([]*FormattedItem, error)
+	TimelinePage(pid PidType, status string, cursor string, count int) (*TimelineRange, error)
+	TimelineWindow(pid PidType, status string, tstart time.Time, tend time.Time, limit int) (*TimelineRange, error)
+	TimelineWindowCount(pid PidType, status string, tstart time.Time, tend time.Time) (int, error)
+	ItemInTimeline(item *Item, pid PidType, status string) ([]*FormattedItem, error)
+	FormatItem(item *Item, ts int64, pid PidType) (*FormattedItem, error)
+	ItemScore(itemKey string, timelineKey string) int64
+	Promote(pid PidType, id ItemIdType) error
+	Demote(pid PidType, id ItemIdType) error
+	DeleteMaybeItems(pid PidType) error
+	AddItemToFollowerTimelines(pid PidType, scheduledTime int64, item *Item) error
+	AddItemToTimeline(pid PidType, source PidType, ts int64, itemKey string) error
+	RemoveItemFromFollowerTimelines(pid PidType, itemKey string) error
+	RemoveItemFromTimeline(pid PidType, source PidType, itemKey string) error
+	WaitForFanout(id ItemIdType, timeout time.Duration) error
+
+	// Following
+	Follow(pid PidType, followpid PidType) error
+	Unfollow(pid PidType, followpid PidType) error
+	Followers(pid PidType, count int, start int) ([]*FollowingProfile, error)
+	Following(pid PidType, count int, start int) ([]*FollowingProfile, error)
+	Follows(pid PidType, follower PidType) (bool, error)
+
+	// Sessions
+	VerifyPassword(pid PidType, password string) (bool, error)
+	VerifyPasswordFrom(pid PidType, password string, client string) (bool, error)
+	UnlockLogin(pid PidType) error
+	UnlockClient(client string) error
+	PidForEmail(email string) (PidType, error)
+	RebuildEmailIndex() (int, error)
+	PasswordResetToken(pid PidType) (string, error)
+	ResetPassword(token string, password string) (PidType, error)
+	EmailVerificationToken(pid PidType) (string, error)
+	VerifyEmail(token string) (PidType, error)
+	CreateApiToken(pid PidType, name string, scopes []string, lifetime time.Duration) (string, *ApiToken, error)
+	ApiTokens(pid PidType) ([]*ApiToken, error)
+	RevokeApiToken(pid PidType, id string) error
+	ValidateApiToken(token string) (PidType, []string, error)
+	ChangePassword(pid PidType, oldPassword string, newPassword string) error
+	SessionId(pid PidType) (string, error)
+	ValidSession(pid PidType, token string) (bool, error)
+	Logout(pid PidType, token string) error
+	RevokeSession(pid PidType, id string) error
+	LogoutAll(pid PidType) (int, error)
+	Sessions(pid PidType) ([]*Session, error)
+	SweepSessions() (int, error)
+	IndexLegacySessions() (int, error)
+	SetOauthSessionData(key string, data string) error
+	GetOauthSessionData(key string) (string, error)
+	SetOauthState(key string, state *OauthState) error
+	TakeOauthState(key string) (*OauthState, error)
+}
+
+var (
+	_ Store = (*RedisStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
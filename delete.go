@@ -0,0 +1,436 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Profiles whose deletion has started but not finished
+const DELETING_PROFILES = "deletingprofiles"
+
+// How long DeleteProfile waits in all for the fan-out workers to remove a
+// profile's items from its followers' timelines
+var DeleteFanoutTimeout = 5 * time.Minute
+
+// Counts the timeline entries removed by the fan-out jobs of a deletion
+func deletionTallyKey(pid PidType) string {
+	return fmt.Sprintf("deleting:%s:timelineentries", pid)
+}
+
+// ProfileDeletion reports what was removed when a profile was deleted
+type ProfileDeletion struct {
+	Pid             PidType            `json:"pid"`
+	Followers       int                `json:"followers"`
+	Following       int                `json:"following"`
+	Items           int                `json:"items"`
+	TimelineEntries int                `json:"timelineentries"`
+	SuggestedSets   int                `json:"suggestedsets"`
+	Sessions        int                `json:"sessions"`
+	ApiTokens       int                `json:"apitokens"`
+	Feeds           []*ProfileDeletion `json:"feeds,omitempty"`
+}
+
+// DeleteProfile removes a profile and everything that refers to it: its
+// follow relationships in both directions, its child feed profiles, the items
+// it authored, its items in followers' timelines, its own timelines and
+// sources, its suggested profile entries and its sessions. Removing its items
+// from followers' timelines is queued for the fan-out workers, and the
+// deletion waits up to DeleteFanoutTimeout for them. It fails with
+// ErrNoFanoutWorkers if there are items to remove but no workers to remove
+// them. Every step can be
+// repeated safely, so an interrupted deletion is completed by calling
+// DeleteProfile again or by ResumeProfileDeletions. The profile's info hash is
+// removed last.
+func (s *RedisStore) DeleteProfile(pid PidType) (*ProfileDeletion, error) {
+	return s.deleteProfile(pid, make(map[PidType]bool))
+}
+
+// deleting holds the profiles already being deleted, so feeds that refer back
+// to one of their parents are only deleted once
+func (s *RedisStore) deleteProfile(pid PidType, deleting map[PidType]bool) (*ProfileDeletion, error) {
+	d := &ProfileDeletion{Pid: pid, Feeds: make([]*ProfileDeletion, 0)}
+	deleting[pid] = true
+
+	rs := s.pdb.Command("SADD", DELETING_PROFILES, pid)
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+
+	p, err := s.Profile(pid)
+	if err != nil {
+		return d, err
+	}
+
+	// Child feeds are owned by this profile so go with it
+	rs = s.pdb.Command("SMEMBERS", feedsKey(pid))
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+	for _, fid := range rs.ValuesAsStrings() {
+		if deleting[PidType(fid)] {
+			continue
+		}
+		fd, err := s.deleteProfile(PidType(fid), deleting)
+		d.Feeds = append(d.Feeds, fd)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	rs = s.tdb.Command("ZRANGE", maybeKey(pid, ORDERING_TS), 0, -1)
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+	itemKeys := rs.ValuesAsStrings()
+
+	// Take this profile's items out of each follower's timeline before
+	// dropping the relationship, since the workers find the followers from it
+	if len(itemKeys) > 0 {
+		running, err := s.fanoutWorkersRunning()
+		if err != nil {
+			return d, err
+		}
+		if !running {
+			return d, ErrNoFanoutWorkers
+		}
+	}
+
+	tallyKey := deletionTallyKey(pid)
+	for _, itemKey := range itemKeys {
+		if err := s.queueFanout(&fanoutJob{Op: fanoutRemove, Source: pid, ItemId: itemIdFromKey(itemKey), Tally: tallyKey}); err != nil {
+			return d, err
+		}
+	}
+	deadline := time.Now().Add(DeleteFanoutTimeout)
+	for _, itemKey := range itemKeys {
+		if err := s.WaitForFanout(itemIdFromKey(itemKey), deadline.Sub(time.Now())); err != nil {
+			return d, err
+		}
+	}
+
+	rs = s.pdb.Command("GET", tallyKey)
+	if !rs.IsOK() && !isKeyNotFound(rs.Error()) {
+		return d, rs.Error()
+	}
+	if rs.IsOK() {
+		d.TimelineEntries, _ = rs.ValueAsInt()
+	}
+
+	rs = s.pdb.Command("ZRANGE", followersKey(pid), 0, -1)
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+	for _, follower := range rs.ValuesAsStrings() {
+		rs := s.pdb.Command("ZREM", followingKey(PidType(follower)), pid)
+		if !rs.IsOK() {
+			return d, rs.Error()
+		}
+		rs = s.pdb.Command("ZREM", followersKey(pid), follower)
+		if !rs.IsOK() {
+			return d, rs.Error()
+		}
+		d.Followers++
+	}
+
+	rs = s.pdb.Command("ZRANGE", followingKey(pid), 0, -1)
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+	for _, followee := range rs.ValuesAsStrings() {
+		rs := s.pdb.Command("ZREM", followersKey(PidType(followee)), pid)
+		if !rs.IsOK() {
+			return d, rs.Error()
+		}
+		d.Following++
+	}
+
+	// Promotions of other profiles' items are dropped from those items
+	for _, itemKey := range itemKeys {
+		item, err := s.ItemByKey(itemKey)
+		if err != nil {
+			if isKeyNotFound(err) {
+				continue
+			}
+			return d, err
+		}
+		if item.Pid != pid {
+			rs := s.tdb.Command("SREM", promotersKey(itemKey), pid)
+			if !rs.IsOK() {
+				return d, rs.Error()
+			}
+		}
+	}
+
+	// Authored items are deleted whether or not they are still in the maybe
+	// timeline. Deleting also removes them from the timelines of anyone who
+	// promoted them.
+	rs = s.idb.Command("SMEMBERS", authoredKey(pid))
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+	for _, id := range rs.ValuesAsStrings() {
+		if err := s.DeleteItem(ItemIdType(id)); err != nil {
+			if isKeyNotFound(err) {
+				continue
+			}
+			return d, err
+		}
+		d.Items++
+	}
+
+	rs = s.idb.Command("DEL", authoredKey(pid))
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+
+	rs = s.tdb.Command("DEL", possiblyKey(pid, ORDERING_TS), maybeKey(pid, ORDERING_TS), sourcesKey(pid))
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+
+	rs = s.pdb.Command("DEL", followingKey(pid), followersKey(pid), feedsKey(pid))
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+
+	rs = s.pdb.Command("SMEMBERS", SUGGESTED_LOCATIONS)
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+	for _, loc := range rs.ValuesAsStrings() {
+		rs := s.pdb.Command("SREM", suggestedProfileKey(loc), pid)
+		if !rs.IsOK() {
+			return d, rs.Error()
+		}
+		if n, _ := rs.ValueAsInt(); n > 0 {
+			d.SuggestedSets++
+		}
+	}
+
+	rs = s.pdb.Command("SREM", FEED_DRIVEN_PROFILES, pid)
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+	if p.ParentPid != "" {
+		rs := s.pdb.Command("SREM", feedsKey(p.ParentPid), pid)
+		if !rs.IsOK() {
+			return d, rs.Error()
+		}
+	}
+	rs = s.pdb.Command("ZREM", FLAGGED_PROFILES, pid)
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+	if err := s.unindexEmail(pid, p.Email); err != nil {
+		return d, err
+	}
+	if err := s.unindexProfile(pid); err != nil {
+		return d, err
+	}
+
+	// Sessions started before they were indexed by profile expire with the
+	// lifetime given them by IndexLegacySessions
+	if d.Sessions, err = s.LogoutAll(pid); err != nil {
+		return d, err
+	}
+
+	if d.ApiTokens, err = s.revokeApiTokens(pid); err != nil {
+		return d, err
+	}
+
+	rs = s.pdb.Command("DEL", profileKey(pid), tallyKey)
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+
+	rs = s.pdb.Command("SREM", DELETING_PROFILES, pid)
+	if !rs.IsOK() {
+		return d, rs.Error()
+	}
+
+	return d, nil
+}
+
+// Completes any profile deletions that were interrupted
+func (s *RedisStore) ResumeProfileDeletions() ([]*ProfileDeletion, error) {
+	deletions := make([]*ProfileDeletion, 0)
+
+	rs := s.pdb.Command("SMEMBERS", DELETING_PROFILES)
+	if !rs.IsOK() {
+		return deletions, rs.Error()
+	}
+
+	for _, pid := range rs.ValuesAsStrings() {
+		applog.Infof("Resuming deletion of profile %s", pid)
+		d, err := s.DeleteProfile(PidType(pid))
+		deletions = append(deletions, d)
+		if err != nil {
+			return deletions, err
+		}
+	}
+
+	return deletions, nil
+}
+
+func (s *MemoryStore) DeleteProfile(pid PidType) (*ProfileDeletion, error) {
+	return s.deleteProfile(pid, make(map[PidType]bool))
+}
+
+func (s *MemoryStore) deleteProfile(pid PidType, deleting map[PidType]bool) (*ProfileDeletion, error) {
+	d := &ProfileDeletion{Pid: pid, Feeds: make([]*ProfileDeletion, 0)}
+	deleting[pid] = true
+
+	s.pdb.sadd(DELETING_PROFILES, string(pid))
+
+	p, err := s.Profile(pid)
+	if err != nil {
+		return d, err
+	}
+
+	for _, fid := range s.pdb.smembers(feedsKey(pid)) {
+		if deleting[PidType(fid)] {
+			continue
+		}
+		fd, err := s.deleteProfile(PidType(fid), deleting)
+		d.Feeds = append(d.Feeds, fd)
+		if err != nil {
+			return d, err
+		}
+	}
+
+	items := s.tdb.zrange(maybeKey(pid, ORDERING_TS), 0, -1)
+
+	for _, follower := range s.pdb.zrange(followersKey(pid), 0, -1) {
+		for _, m := range items {
+			if s.removeFromTimeline(PidType(follower.member), pid, m.member) {
+				d.TimelineEntries++
+			}
+		}
+		s.pdb.zrem(followingKey(PidType(follower.member)), string(pid))
+		s.pdb.zrem(followersKey(pid), follower.member)
+		d.Followers++
+	}
+
+	for _, followee := range s.pdb.zrange(followingKey(pid), 0, -1) {
+		s.pdb.zrem(followersKey(PidType(followee.member)), string(pid))
+		d.Following++
+	}
+
+	for _, m := range items {
+		item, err := s.ItemByKey(m.member)
+		if err == nil && item.Pid != pid {
+			s.tdb.srem(promotersKey(m.member), string(pid))
+		}
+	}
+
+	for _, id := range s.idb.smembers(authoredKey(pid)) {
+		if s.DeleteItem(ItemIdType(id)) == nil {
+			d.Items++
+		}
+	}
+	s.idb.del(authoredKey(pid))
+
+	s.tdb.del(possiblyKey(pid, ORDERING_TS), maybeKey(pid, ORDERING_TS), sourcesKey(pid))
+	s.pdb.del(followingKey(pid), followersKey(pid), feedsKey(pid))
+
+	for _, loc := range s.pdb.smembers(SUGGESTED_LOCATIONS) {
+		if s.pdb.sismember(suggestedProfileKey(loc), string(pid)) {
+			s.pdb.srem(suggestedProfileKey(loc), string(pid))
+			d.SuggestedSets++
+		}
+	}
+
+	s.pdb.srem(FEED_DRIVEN_PROFILES, string(pid))
+	if p.ParentPid != "" {
+		s.pdb.srem(feedsKey(p.ParentPid), string(pid))
+	}
+	s.pdb.zrem(FLAGGED_PROFILES, string(pid))
+	s.unindexEmail(pid, p.Email)
+	s.unindexProfile(pid)
+
+	d.Sessions, _ = s.LogoutAll(pid)
+	d.ApiTokens, _ = s.revokeApiTokens(pid)
+
+	s.pdb.del(string(profileKey(pid)))
+	s.pdb.srem(DELETING_PROFILES, string(pid))
+
+	return d, nil
+}
+
+// Deletions in memory are never interrupted part way through
+func (s *MemoryStore) ResumeProfileDeletions() ([]*ProfileDeletion, error) {
+	return make([]*ProfileDeletion, 0), nil
+}
+
+// Indexes the items each profile has authored and the locations that have
+// suggested profiles, returning the number of items and locations indexed.
+// Only needed for data added before DeleteProfile relied on these indexes.
+func (s *RedisStore) RebuildDeletionIndexes() (int, error) {
+	n := 0
+
+	err := scanKeys(s.idb, ItemKey("*"), func(keys []string) error {
+		for _, key := range keys {
+			item, err := s.ItemByKey(key)
+			if err != nil {
+				if isKeyNotFound(err) {
+					continue
+				}
+				return err
+			}
+			if item.Pid == "" {
+				continue
+			}
+			rs := s.idb.Command("SADD", authoredKey(item.Pid), item.Id)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	err = scanKeys(s.pdb, suggestedProfileKey("*"), func(keys []string) error {
+		for _, key := range keys {
+			loc := strings.TrimPrefix(key, suggestedProfileKey(""))
+			rs := s.pdb.Command("SADD", SUGGESTED_LOCATIONS, loc)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+			n++
+		}
+		return nil
+	})
+
+	return n, err
+}
+
+func (s *MemoryStore) RebuildDeletionIndexes() (int, error) {
+	n := 0
+
+	items := s.idb.keys(func(key string) bool {
+		return strings.HasPrefix(key, ItemKey(""))
+	})
+	for _, key := range items {
+		item, err := s.ItemByKey(key)
+		if err != nil || item.Pid == "" {
+			continue
+		}
+		s.idb.sadd(authoredKey(item.Pid), string(item.Id))
+		n++
+	}
+
+	suggested := s.pdb.keys(func(key string) bool {
+		return strings.HasPrefix(key, suggestedProfileKey(""))
+	})
+	for _, key := range suggested {
+		s.pdb.sadd(SUGGESTED_LOCATIONS, strings.TrimPrefix(key, suggestedProfileKey("")))
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeleteProfile(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		// alice and her feed each list the other as a feed
+		if err := s.AddProfile("alicefeed", "secret", "feed", "", "", "", "alice", "", "", "", "", "", ""); err != nil {
+			t.Fatalf("AddProfile: %s", err)
+		}
+		if err := s.AddProfile("alice", "secret", "alice", "", "", "", "alicefeed", "", "", "", "", "", ""); err != nil {
+			t.Fatalf("AddProfile: %s", err)
+		}
+		addTestProfile(t, s, "bob")
+		addTestProfile(t, s, "carol")
+
+		if err := s.Follow("bob", "alice"); err != nil {
+			t.Fatalf("Follow: %s", err)
+		}
+		if err := s.AddSuggestedProfile("alice", "london"); err != nil {
+			t.Fatalf("AddSuggestedProfile: %s", err)
+		}
+
+		demoted := addTestItem(t, s, "alice", "demoted")
+		if err := s.Demote("alice", demoted); err != nil {
+			t.Fatalf("Demote: %s", err)
+		}
+		if err := s.WaitForFanout(demoted, 5*time.Second); err != nil {
+			t.Fatalf("WaitForFanout: %s", err)
+		}
+		kept := addTestItem(t, s, "alice", "kept")
+
+		promoted := addTestItem(t, s, "carol", "promoted")
+		if err := s.Promote("alice", promoted); err != nil {
+			t.Fatalf("Promote: %s", err)
+		}
+		if err := s.WaitForFanout(promoted, 5*time.Second); err != nil {
+			t.Fatalf("WaitForFanout: %s", err)
+		}
+
+		d, err := s.DeleteProfile("alice")
+		if err != nil {
+			t.Fatalf("DeleteProfile: %s", err)
+		}
+
+		if len(d.Feeds) != 1 || d.Feeds[0].Pid != "alicefeed" {
+			t.Errorf("deleted feeds = %+v, want alicefeed", d.Feeds)
+		}
+		if d.Items != 2 || d.TimelineEntries != 2 || d.Followers != 1 || d.SuggestedSets != 1 {
+			t.Errorf("deletion = %+v, want 2 items, 2 timeline entries, 1 follower and 1 suggested set", d)
+		}
+
+		for _, id := range []ItemIdType{demoted, kept} {
+			if exists, err := s.ItemExists(id); err != nil || exists {
+				t.Errorf("ItemExists(%s) = %v, %v after deletion", id, exists, err)
+			}
+		}
+		if exists, err := s.ItemExists(promoted); err != nil || !exists {
+			t.Errorf("ItemExists(%s) = %v, %v, promoted item was deleted", promoted, exists, err)
+		}
+		if ids := timelineIds(t, s, "bob", "p"); len(ids) != 0 {
+			t.Errorf("bob's possibly timeline = %v, want none", ids)
+		}
+
+		for _, pid := range []PidType{"alice", "alicefeed"} {
+			if exists, err := s.ProfileExists(pid); err != nil || exists {
+				t.Errorf("ProfileExists(%s) = %v, %v after deletion", pid, exists, err)
+			}
+		}
+		if profiles, err := s.SuggestedProfiles("london"); err != nil || len(profiles) != 0 {
+			t.Errorf("SuggestedProfiles = %v, %v, want none", profiles, err)
+		}
+	})
+}
+
+func TestDeleteProfileWithoutWorkers(t *testing.T) {
+	config := testRedisConfig(t)
+	config.Fanout.NoWorkers = true
+	s := newTestRedisStoreFrom(t, config)
+	defer s.Close()
+
+	addTestProfile(t, s, "alice")
+	for i := 0; i < 3; i++ {
+		if _, err := s.AddItem("alice", time.Time{}, "hello", "", "", "", "text", 0); err != nil {
+			t.Fatalf("AddItem: %s", err)
+		}
+	}
+
+	if _, err := s.DeleteProfile("alice"); err != ErrNoFanoutWorkers {
+		t.Errorf("DeleteProfile = %v, want %v", err, ErrNoFanoutWorkers)
+	}
+
+	// A worker elsewhere holds a lease but never gets to the jobs, so the
+	// deletion waits once for all of them
+	s.pdb.Command("SET", fanoutLeaseKey(0), "elsewhere")
+	defer func(timeout time.Duration) { DeleteFanoutTimeout = timeout }(DeleteFanoutTimeout)
+	DeleteFanoutTimeout = 500 * time.Millisecond
+
+	start := time.Now()
+	if _, err := s.DeleteProfile("alice"); err != ErrFanoutTimeout {
+		t.Errorf("DeleteProfile = %v, want %v", err, ErrFanoutTimeout)
+	}
+	if waited := time.Since(start); waited > 2*DeleteFanoutTimeout {
+		t.Errorf("DeleteProfile waited %s, want about %s", waited, DeleteFanoutTimeout)
+	}
+}
@@ -0,0 +1,206 @@
+package datastore
+
+import (
+	"bytes"
+	"code.google.com/p/go.net/html"
+	"errors"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrNoImageFound = errors.New("datastore: no image found on linked page")
+
+// Media types accepted for linked pages
+var pageTypes = []string{"text/html", "application/xhtml+xml"}
+
+const (
+	// Inline images smaller than this are assumed to be icons or spacers
+	discoverMinWidth  = 200
+	discoverMinHeight = 100
+)
+
+// Scores for each way a page can nominate an image. Inline images score
+// below these, more for larger images. Inline images without a width and
+// height may be icons as easily as illustrations, so they score lowest and
+// are only used when nothing else is found.
+const (
+	scoreOpenGraph = 1000
+	scoreTwitter   = 900
+	scoreImageSrc  = 800
+	scoreInline    = 0
+	scoreUnsized   = -1
+)
+
+type imageCandidate struct {
+	url   string
+	score int
+	order int
+}
+
+type byImageScore []imageCandidate
+
+func (c byImageScore) Len() int      { return len(c) }
+func (c byImageScore) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byImageScore) Less(i, j int) bool {
+	if c[i].score == c[j].score {
+		return c[i].order < c[j].order
+	}
+	return c[i].score > c[j].score
+}
+
+// FindImages reads an HTML page and returns the absolute URLs of the images
+// it contains, best first. Images named by og:image are preferred to
+// twitter:image, then link rel=image_src, then inline images large enough to
+// be illustrations, largest first, then inline images of unknown size in the
+// order they appear.
+func FindImages(pageUrl string, r io.Reader) ([]string, error) {
+	base, err := url.Parse(pageUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := make([]imageCandidate, 0)
+	add := func(ref string, score int) {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			return
+		}
+		u, err := base.Parse(ref)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return
+		}
+		candidates = append(candidates, imageCandidate{url: u.String(), score: score, order: len(candidates)})
+	}
+
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() != io.EOF {
+				return nil, z.Err()
+			}
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+
+		tok := z.Token()
+		attrs := make(map[string]string, len(tok.Attr))
+		for _, a := range tok.Attr {
+			attrs[strings.ToLower(a.Key)] = a.Val
+		}
+
+		switch tok.Data {
+		case "base":
+			if href, exists := attrs["href"]; exists {
+				if u, err := base.Parse(href); err == nil {
+					base = u
+				}
+			}
+
+		case "meta":
+			name := strings.ToLower(attrs["property"])
+			if name == "" {
+				name = strings.ToLower(attrs["name"])
+			}
+			switch name {
+			case "og:image", "og:image:url", "og:image:secure_url":
+				add(attrs["content"], scoreOpenGraph)
+			case "twitter:image", "twitter:image:src":
+				add(attrs["content"], scoreTwitter)
+			}
+
+		case "link":
+			for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+				if rel == "image_src" {
+					add(attrs["href"], scoreImageSrc)
+				}
+			}
+
+		case "img":
+			// A missing or unreadable dimension is left as zero
+			width, _ := strconv.Atoi(strings.TrimSuffix(attrs["width"], "px"))
+			height, _ := strconv.Atoi(strings.TrimSuffix(attrs["height"], "px"))
+			switch {
+			case (width > 0 && width < discoverMinWidth) || (height > 0 && height < discoverMinHeight):
+				// Too small in at least one dimension
+			case width == 0 || height == 0:
+				add(attrs["src"], scoreUnsized)
+			default:
+				area := width * height / 1000
+				if area >= scoreImageSrc {
+					area = scoreImageSrc - 1
+				}
+				add(attrs["src"], scoreInline+area)
+			}
+		}
+	}
+
+	sort.Sort(byImageScore(candidates))
+
+	urls := make([]string, 0, len(candidates))
+	seen := make(map[string]bool)
+	for _, c := range candidates {
+		if !seen[c.url] {
+			seen[c.url] = true
+			urls = append(urls, c.url)
+		}
+	}
+
+	return urls, nil
+}
+
+// DiscoverImage fetches the page at link and returns the URL of its best image
+func DiscoverImage(link string, fetcher Fetcher) (string, error) {
+	res, err := fetcher.Fetch(link, pageTypes, "", "")
+	if err != nil {
+		return "", err
+	}
+
+	urls, err := FindImages(res.Url, bytes.NewReader(res.Body))
+	if err != nil {
+		return "", err
+	}
+
+	if len(urls) == 0 {
+		return "", Permanent(ErrNoImageFound)
+	}
+
+	return urls[0], nil
+}
+
+// Finds the image for an item from the page it links to, caches it and saves
+// the item. Suitable for passing to StartImageWorkers.
+func (s *RedisStore) ImageFromLink(item *Item) error {
+	imageUrl, err := DiscoverImage(item.Link, s.fetcher)
+	if err != nil {
+		return err
+	}
+
+	cached, err := s.cacheImage(imageUrl)
+	if err != nil {
+		return err
+	}
+
+	setItemImage(item, cached, s.config.Images.Variants)
+	return s.UpdateItem(item)
+}
+
+func (s *MemoryStore) ImageFromLink(item *Item) error {
+	imageUrl, err := DiscoverImage(item.Link, s.fetcher)
+	if err != nil {
+		return err
+	}
+
+	cached, err := s.cacheImage(imageUrl)
+	if err != nil {
+		return err
+	}
+
+	setItemImage(item, cached, s.config.Images.Variants)
+	return s.UpdateItem(item)
+}
@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestFetcher() *SafeFetcher {
+	return NewSafeFetcher(FetchConfig{Timeout: 5, MaxBytes: 1 << 20, MaxRedirects: 5, AllowPrivate: true})
+}
+
+// Serves each page as HTML, except for paths given their own handler
+func newTestPageServer(pages map[string]string, handlers map[string]http.HandlerFunc) *httptest.Server {
+	mux := http.NewServeMux()
+	for path, page := range pages {
+		page := page
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, page)
+		})
+	}
+	for path, handler := range handlers {
+		mux.HandleFunc(path, handler)
+	}
+	return httptest.NewServer(mux)
+}
+
+func sameUrls(a []string, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestFindImagesOrder(t *testing.T) {
+	page := `<html><head>
+		<link rel="image_src" href="http://example.com/imagesrc.png">
+		<meta name="twitter:image" content="http://example.com/twitter.png">
+		<meta property="og:image" content="http://example.com/og.png">
+	</head><body>
+		<img src="http://example.com/unsized.png">
+		<img src="http://example.com/icon.png" width="16" height="16">
+		<img src="http://example.com/small.png" width="300" height="200">
+		<img src="http://example.com/large.png" width="600" height="400">
+		<img src="http://example.com/narrow.png" width="50">
+	</body></html>`
+
+	srv := newTestPageServer(map[string]string{"/": page}, nil)
+	defer srv.Close()
+
+	res, err := newTestFetcher().Fetch(srv.URL+"/", pageTypes, "", "")
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	urls, err := FindImages(res.Url, bytes.NewReader(res.Body))
+	if err != nil {
+		t.Fatalf("FindImages: %s", err)
+	}
+
+	want := []string{
+		"http://example.com/og.png",
+		"http://example.com/twitter.png",
+		"http://example.com/imagesrc.png",
+		"http://example.com/large.png",
+		"http://example.com/small.png",
+		"http://example.com/unsized.png",
+	}
+	if !sameUrls(urls, want...) {
+		t.Errorf("FindImages = %v, want %v", urls, want)
+	}
+}
+
+func TestDiscoverImage(t *testing.T) {
+	pages := map[string]string{
+		"/based":         `<base href="http://cdn.example.com/static/"><meta property="og:image" content="og.png">`,
+		"/articles/page": `<img src="pic.png" width="400" height="300">`,
+		"/rooted":        `<meta name="twitter:image" content="/img/twitter.png">`,
+		"/unsized":       `<img src="a.png"><img src="b.png">`,
+		"/icons":         `<img src="icon.png" width="16" height="16">`,
+	}
+	handlers := map[string]http.HandlerFunc{
+		"/moved": func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/articles/page", http.StatusMovedPermanently)
+		},
+		"/image.png": func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			fmt.Fprint(w, "png")
+		},
+	}
+	srv := newTestPageServer(pages, handlers)
+	defer srv.Close()
+
+	fetcher := newTestFetcher()
+
+	found := []struct {
+		path string
+		want string
+	}{
+		{"/based", "http://cdn.example.com/static/og.png"},
+		{"/rooted", srv.URL + "/img/twitter.png"},
+		// Relative URLs are resolved against the page reached by redirects
+		{"/moved", srv.URL + "/articles/pic.png"},
+		{"/unsized", srv.URL + "/a.png"},
+	}
+	for _, f := range found {
+		image, err := DiscoverImage(srv.URL+f.path, fetcher)
+		if err != nil {
+			t.Errorf("DiscoverImage(%s): %s", f.path, err)
+			continue
+		}
+		if image != f.want {
+			t.Errorf("DiscoverImage(%s) = %s, want %s", f.path, image, f.want)
+		}
+	}
+
+	// None of these will succeed if tried again
+	for _, path := range []string{"/icons", "/missing", "/image.png"} {
+		if _, err := DiscoverImage(srv.URL+path, fetcher); err == nil || !isPermanent(err) {
+			t.Errorf("DiscoverImage(%s) = %v, want a permanent error", path, err)
+		}
+	}
+}
@@ -0,0 +1,559 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Changes that must be copied to other profiles' timelines are written to a
+// queue in the profile database and applied by background workers. Jobs are
+// sharded by the profile whose items are being distributed so that changes
+// from one profile are always applied in the order they were made. Each shard
+// is processed by a single worker at a time, which holds a lease on the shard.
+
+const (
+	FANOUT_JOB_ID  = "fanoutjobid"
+	FANOUT_FAILED  = "fanoutfailed"
+	FanoutShards   = 8
+	FanoutAttempts = 5
+
+	fanoutAdd      = "add"
+	fanoutRemove   = "remove"
+	fanoutFollow   = "follow"
+	fanoutUnfollow = "unfollow"
+	fanoutSchedule = "schedule"
+
+	fanoutBatchSize   = 100
+	fanoutLeaseTime   = 30 // seconds
+	fanoutPollTimeout = 1  // seconds
+)
+
+var (
+	ErrFanoutTimeout   = errors.New("datastore: timed out waiting for fan-out")
+	ErrNoFanoutWorkers = errors.New("datastore: no fan-out workers are running")
+
+	errFanoutLeaseLost = errors.New("datastore: fan-out shard leased to another worker")
+)
+
+type fanoutJob struct {
+	Id      string     `json:"id"`
+	Op      string     `json:"op"`
+	Source  PidType    `json:"source"`
+	Pid     PidType    `json:"pid,omitempty"`
+	ItemId  ItemIdType `json:"itemid,omitempty"`
+	ItemPid PidType    `json:"itempid,omitempty"`
+	Ts      int64      `json:"ts,omitempty"`
+	Tally   string     `json:"tally,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// fanoutWorkers tracks the workers started by a store
+type fanoutWorkers struct {
+	owner string
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func fanoutQueueKey(shard int) string {
+	return fmt.Sprintf("fanoutqueue:%d", shard)
+}
+
+func fanoutProcessingKey(shard int) string {
+	return fmt.Sprintf("fanoutqueue:%d:processing", shard)
+}
+
+func fanoutLeaseKey(shard int) string {
+	return fmt.Sprintf("fanoutqueue:%d:lease", shard)
+}
+
+func fanoutProgressKey(jobId string) string {
+	return fmt.Sprintf("fanoutjob:%s:progress", jobId)
+}
+
+func fanoutPendingKey(itemKey string) string {
+	return fmt.Sprintf("fanoutpending:%s", itemKey)
+}
+
+// fanoutCursor is the last member of a follower list or timeline that a job
+// has been applied to. Members are ordered by score then member, as for
+// timeline cursors, so members added or removed while a job runs don't cause
+// others to be skipped or repeated.
+type fanoutCursor struct {
+	score  float64
+	member string
+}
+
+func (c *fanoutCursor) String() string {
+	return fmt.Sprintf("%s|%s", strconv.FormatFloat(c.score, 'f', -1, 64), c.member)
+}
+
+func parseFanoutCursor(progress string) (*fanoutCursor, error) {
+	parts := strings.SplitN(progress, "|", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid fan-out progress %q", progress)
+	}
+
+	score, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid fan-out progress %q", progress)
+	}
+
+	return &fanoutCursor{score: score, member: parts[1]}, nil
+}
+
+// Extends a lease, but only if it is still held by the given owner.
+// KEYS: lease
+// ARGV: owner, seconds
+var renewLeaseScript = newLuaScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('EXPIRE', KEYS[1], ARGV[2])
+`)
+
+// Deletes a lease if it is held by the given owner.
+// KEYS: lease
+// ARGV: owner
+var releaseLeaseScript = newLuaScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call('DEL', KEYS[1])
+`)
+
+// Queues a job, counting it against its item's pending jobs only once it has
+// been queued, so a job that can't be queued is never waited for.
+// KEYS: queue[, pending count]
+// ARGV: job
+var queueFanoutJobScript = newLuaScript(`
+redis.call('LPUSH', KEYS[1], ARGV[1])
+if KEYS[2] then
+	redis.call('INCR', KEYS[2])
+end
+return 1
+`)
+
+// Removes a job from a shard's processing list, records it if it failed and
+// counts it off its item's pending jobs. Nothing is done unless the shard is
+// still leased to the given owner, so a job taken over by another worker is
+// only finished once.
+// KEYS: lease, processing list, progress, failed list[, pending count]
+// ARGV: owner, job, failed job or ""
+var finishFanoutJobScript = newLuaScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('LREM', KEYS[2], 1, ARGV[2])
+redis.call('DEL', KEYS[3])
+if ARGV[3] ~= '' then
+	redis.call('LPUSH', KEYS[4], ARGV[3])
+end
+if KEYS[5] and redis.call('DECR', KEYS[5]) <= 0 then
+	redis.call('DEL', KEYS[5])
+end
+return 1
+`)
+
+func fanoutShard(source PidType) int {
+	hasher := fnv.New32a()
+	hasher.Write([]byte(source))
+	return int(hasher.Sum32() % FanoutShards)
+}
+
+// Queues the distribution of item to the timelines of pid's followers
+func (s *RedisStore) queueAddToFollowers(pid PidType, scheduledTime int64, item *Item) error {
+	return s.queueFanout(&fanoutJob{Op: fanoutAdd, Source: pid, ItemId: item.Id, ItemPid: item.Pid, Ts: scheduledTime})
+}
+
+// Queues the removal of an item from the timelines of pid's followers
+func (s *RedisStore) queueRemoveFromFollowers(pid PidType, id ItemIdType) error {
+	return s.queueFanout(&fanoutJob{Op: fanoutRemove, Source: pid, ItemId: id})
+}
+
+// Queues moving an item to a new time in the timelines of pid's followers
+func (s *RedisStore) queueRescheduleInFollowers(pid PidType, id ItemIdType, scheduledTime int64) error {
+	return s.queueFanout(&fanoutJob{Op: fanoutSchedule, Source: pid, ItemId: id, Ts: scheduledTime})
+}
+
+func (s *RedisStore) queueFanout(job *fanoutJob) error {
+	rs := s.pdb.Command("INCR", FANOUT_JOB_ID)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	job.Id = rs.ValueAsString()
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{fanoutQueueKey(fanoutShard(job.Source))}
+	if job.ItemId != "" {
+		keys = append(keys, fanoutPendingKey(ItemKey(job.ItemId)))
+	}
+
+	rs = queueFanoutJobScript.run(s.pdb, keys, data)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// Waits until every queued fan-out job for the item has been applied or has
+// permanently failed
+func (s *RedisStore) WaitForFanout(id ItemIdType, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	pendingKey := fanoutPendingKey(ItemKey(id))
+
+	for {
+		rs := s.pdb.Command("GET", pendingKey)
+		if !rs.IsOK() {
+			if !isKeyNotFound(rs.Error()) {
+				return rs.Error()
+			}
+			return nil
+		}
+
+		if pending, err := rs.ValueAsInt(); err != nil || pending <= 0 {
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return ErrFanoutTimeout
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Reports whether any fan-out workers are running, either started by this
+// store or holding a lease from another process
+func (s *RedisStore) fanoutWorkersRunning() (bool, error) {
+	if s.fanout != nil {
+		return true, nil
+	}
+
+	for shard := 0; shard < FanoutShards; shard++ {
+		rs := s.pdb.Command("EXISTS", fanoutLeaseKey(shard))
+		if !rs.IsOK() {
+			return false, rs.Error()
+		}
+		if exists, _ := rs.ValueAsBool(); exists {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Starts a worker for each fan-out shard. NewRedisStore does this unless
+// Config.Fanout.NoWorkers is set. Workers in other processes sharing the same
+// databases take over any shard whose lease lapses. The workers are stopped
+// by Close.
+func (s *RedisStore) StartFanoutWorkers() error {
+	if s.fanout != nil {
+		return fmt.Errorf("fan-out workers already started")
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	s.fanout = &fanoutWorkers{
+		owner: hex.EncodeToString(b),
+		stop:  make(chan struct{}),
+	}
+
+	for shard := 0; shard < FanoutShards; shard++ {
+		s.fanout.wg.Add(1)
+		go s.fanoutWorker(shard)
+	}
+
+	return nil
+}
+
+func (s *RedisStore) stopFanoutWorkers() {
+	if s.fanout == nil {
+		return
+	}
+	close(s.fanout.stop)
+	s.fanout.wg.Wait()
+	s.fanout = nil
+}
+
+func (s *RedisStore) stopping() bool {
+	select {
+	case <-s.fanout.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *RedisStore) fanoutWorker(shard int) {
+	defer s.fanout.wg.Done()
+	defer s.releaseFanoutLease(shard)
+
+	held := false
+	for !s.stopping() {
+		acquired, renewed := s.holdFanoutLease(shard)
+		if !acquired && !renewed {
+			held = false
+			select {
+			case <-s.fanout.stop:
+			case <-time.After(fanoutPollTimeout * time.Second):
+			}
+			continue
+		}
+
+		if !held {
+			// A previous holder may have died part way through a job
+			s.resumeFanoutJobs(shard)
+			held = true
+		}
+
+		rs := s.pdb.Command("BRPOPLPUSH", fanoutQueueKey(shard), fanoutProcessingKey(shard), fanoutPollTimeout)
+		if !rs.IsOK() {
+			if !isKeyNotFound(rs.Error()) {
+				applog.Errorf("Could not read fan-out queue %d: %s", shard, rs.Error().Error())
+				time.Sleep(fanoutPollTimeout * time.Second)
+			}
+			continue
+		}
+
+		if data := rs.ValueAsString(); data != "" {
+			s.runFanoutJob(shard, data)
+		}
+	}
+}
+
+// Takes or renews the lease on a shard. Reports whether the lease was newly
+// acquired or renewed.
+func (s *RedisStore) holdFanoutLease(shard int) (acquired bool, renewed bool) {
+	rs := s.pdb.Command("SET", fanoutLeaseKey(shard), s.fanout.owner, "NX", "EX", fanoutLeaseTime)
+	if rs.IsOK() && rs.ValueAsString() == "OK" {
+		return true, false
+	}
+
+	return false, s.renewFanoutLease(shard)
+}
+
+// Extends the lease on a shard. Reports false if the lease has passed to
+// another worker.
+func (s *RedisStore) renewFanoutLease(shard int) bool {
+	rs := renewLeaseScript.run(s.pdb, []string{fanoutLeaseKey(shard)}, s.fanout.owner, fanoutLeaseTime)
+	if !rs.IsOK() {
+		applog.Errorf("Could not renew lease on fan-out shard %d: %s", shard, rs.Error().Error())
+		return false
+	}
+
+	renewed, _ := rs.ValueAsBool()
+	return renewed
+}
+
+// Gives up the lease so another worker can take over the shard immediately
+func (s *RedisStore) releaseFanoutLease(shard int) {
+	releaseLeaseScript.run(s.pdb, []string{fanoutLeaseKey(shard)}, s.fanout.owner)
+}
+
+func (s *RedisStore) resumeFanoutJobs(shard int) {
+	for !s.stopping() {
+		rs := s.pdb.Command("LINDEX", fanoutProcessingKey(shard), -1)
+		if !rs.IsOK() || rs.ValueAsString() == "" {
+			return
+		}
+		applog.Infof("Resuming interrupted fan-out job in shard %d", shard)
+		if !s.runFanoutJob(shard, rs.ValueAsString()) {
+			return
+		}
+	}
+}
+
+// Applies a job, retrying with backoff. The shard is blocked while a job is
+// retried so later changes from the same profile are not applied first.
+// Reports false if the job was left unfinished, either because the worker is
+// stopping or because the shard's lease passed to another worker.
+func (s *RedisStore) runFanoutJob(shard int, data string) bool {
+	job := &fanoutJob{}
+	err := json.Unmarshal([]byte(data), job)
+
+	for attempt := 1; err == nil; attempt++ {
+		if err = s.applyFanoutJob(shard, job); err == nil || err == errFanoutLeaseLost {
+			break
+		}
+
+		applog.Errorf("Fan-out job %s failed on attempt %d: %s", job.Id, attempt, err.Error())
+		if attempt >= FanoutAttempts || s.stopping() {
+			break
+		}
+		time.Sleep(time.Duration(100<<uint(attempt)) * time.Millisecond)
+		if !s.renewFanoutLease(shard) {
+			err = errFanoutLeaseLost
+			break
+		}
+	}
+
+	if err == errFanoutLeaseLost {
+		applog.Infof("Fan-out shard %d was taken over part way through job %s", shard, job.Id)
+		return false
+	}
+
+	if err != nil && s.stopping() {
+		// Leave the job in the processing list to be resumed later
+		return false
+	}
+
+	failed := ""
+	if err != nil {
+		job.Error = err.Error()
+		b, _ := json.Marshal(job)
+		failed = string(b)
+	}
+
+	return s.finishFanoutJob(shard, job, data, failed)
+}
+
+// Removes a job from the processing list, recording it as failed if failed
+// isn't empty. Reports false if the shard's lease passed to another worker,
+// which will finish the job instead.
+func (s *RedisStore) finishFanoutJob(shard int, job *fanoutJob, data string, failed string) bool {
+	keys := []string{fanoutLeaseKey(shard), fanoutProcessingKey(shard), fanoutProgressKey(job.Id), FANOUT_FAILED}
+	if job.ItemId != "" {
+		keys = append(keys, fanoutPendingKey(ItemKey(job.ItemId)))
+	}
+
+	rs := finishFanoutJobScript.run(s.pdb, keys, s.fanout.owner, data, failed)
+	if !rs.IsOK() {
+		applog.Errorf("Could not finish fan-out job %s: %s", job.Id, rs.Error().Error())
+		return false
+	}
+
+	if finished, _ := rs.ValueAsBool(); !finished {
+		applog.Infof("Fan-out shard %d was taken over before job %s finished", shard, job.Id)
+		return false
+	}
+
+	return true
+}
+
+// Applies the job in batches, recording the last member it was applied to so
+// a retried or resumed job doesn't start from the beginning. The shard's
+// lease is renewed before each batch and the job abandoned if the lease has
+// passed to another worker, so a worker that has lost its lease applies
+// nothing more.
+func (s *RedisStore) applyFanoutJob(shard int, job *fanoutJob) error {
+	progressKey := fanoutProgressKey(job.Id)
+
+	var after *fanoutCursor
+	rs := s.pdb.Command("GET", progressKey)
+	if rs.IsOK() {
+		var err error
+		if after, err = parseFanoutCursor(rs.ValueAsString()); err != nil {
+			applog.Errorf("Restarting fan-out job %s: %s", job.Id, err.Error())
+		}
+	}
+
+	for {
+		if !s.renewFanoutLease(shard) {
+			return errFanoutLeaseLost
+		}
+
+		batch, err := s.fanoutBatch(job, after)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+
+		removed := 0
+		for _, m := range batch {
+			var err error
+			switch job.Op {
+			case fanoutAdd:
+				// Don't add circular references
+				if PidType(m.member) != job.ItemPid {
+					err = s.AddItemToTimeline(PidType(m.member), job.Source, job.Ts, ItemKey(job.ItemId))
+				}
+			case fanoutRemove:
+				var ok bool
+				if ok, err = s.removeFromTimeline(PidType(m.member), job.Source, ItemKey(job.ItemId)); ok {
+					removed++
+				}
+			case fanoutSchedule:
+				err = s.rescheduleInTimeline(possiblyKey(PidType(m.member), ORDERING_TS), job.Ts, ItemKey(job.ItemId))
+			case fanoutFollow:
+				err = s.AddItemToTimeline(job.Pid, job.Source, int64(m.score), m.member)
+			case fanoutUnfollow:
+				err = s.RemoveItemFromTimeline(job.Pid, job.Source, m.member)
+			default:
+				return fmt.Errorf("unknown fan-out operation %s", job.Op)
+			}
+
+			if err != nil && !isKeyNotFound(err) {
+				return err
+			}
+		}
+
+		// Removals are only counted once, since removing again finds nothing
+		if job.Tally != "" && removed > 0 {
+			rs = s.pdb.Command("INCRBY", job.Tally, removed)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+		}
+
+		last := batch[len(batch)-1]
+		after = &fanoutCursor{score: last.score, member: last.member}
+		rs = s.pdb.Command("SET", progressKey, after.String())
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+	}
+}
+
+// Reads the next batch of followers or timeline items that the job applies
+// to, in order of score, following the member after
+func (s *RedisStore) fanoutBatch(job *fanoutJob, after *fanoutCursor) ([]scoredMember, error) {
+	db, key := s.pdb, followersKey(job.Source)
+	if job.Op == fanoutFollow || job.Op == fanoutUnfollow {
+		db, key = s.tdb, maybeKey(job.Source, ORDERING_TS)
+	}
+
+	if after == nil {
+		return scanSortedSet(db, key, scoreRange{min: math.Inf(-1), max: math.Inf(1)}, fanoutBatchSize, false)
+	}
+
+	tied, err := scanSortedSet(db, key, scoreRange{min: after.score, max: after.score}, -1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	batch := make([]scoredMember, 0, fanoutBatchSize)
+	for _, m := range tied {
+		if m.member > after.member && len(batch) < fanoutBatchSize {
+			batch = append(batch, m)
+		}
+	}
+
+	if len(batch) < fanoutBatchSize {
+		more, err := scanSortedSet(db, key, scoreRange{min: after.score, max: math.Inf(1), minExclusive: true}, fanoutBatchSize-len(batch), false)
+		if err != nil {
+			return nil, err
+		}
+		batch = append(batch, more...)
+	}
+
+	return batch, nil
+}
@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Adds n followers to pid directly, giving groups of them the same score so
+// that batches end part way through a tie
+func addTestFollowers(t *testing.T, s *RedisStore, pid PidType, n int) []PidType {
+	followers := make([]PidType, 0, n)
+	for i := 0; i < n; i++ {
+		follower := PidType(fmt.Sprintf("follower%03d", i))
+		rs := s.pdb.Command("ZADD", followersKey(pid), i/7, follower)
+		if !rs.IsOK() {
+			t.Fatalf("ZADD: %s", rs.Error())
+		}
+		followers = append(followers, follower)
+	}
+	return followers
+}
+
+func inPossibly(t *testing.T, s *RedisStore, pid PidType, itemKey string) bool {
+	rs := s.tdb.Command("ZSCORE", possiblyKey(pid, ORDERING_TS), itemKey)
+	if !rs.IsOK() {
+		if isKeyNotFound(rs.Error()) {
+			return false
+		}
+		t.Fatalf("ZSCORE: %s", rs.Error())
+	}
+	return true
+}
+
+func TestFanoutBatches(t *testing.T) {
+	s := newTestRedisStore(t)
+	defer s.Close()
+
+	addTestProfile(t, s, "alice")
+	followers := addTestFollowers(t, s, "alice", fanoutBatchSize*2+fanoutBatchSize/2)
+
+	id := addTestItem(t, s, "alice", "hello")
+	for _, follower := range followers {
+		if !inPossibly(t, s, follower, ItemKey(id)) {
+			t.Fatalf("item not added to the timeline of %s", follower)
+		}
+	}
+
+	if err := s.Demote("alice", id); err != nil {
+		t.Fatalf("Demote: %s", err)
+	}
+	if err := s.WaitForFanout(id, 5*time.Second); err != nil {
+		t.Fatalf("WaitForFanout: %s", err)
+	}
+	for _, follower := range followers {
+		if inPossibly(t, s, follower, ItemKey(id)) {
+			t.Fatalf("item not removed from the timeline of %s", follower)
+		}
+	}
+}
+
+func TestFanoutLeaseLost(t *testing.T) {
+	s := newTestRedisStore(t)
+	defer s.Close()
+
+	// Run jobs by hand as worker "a"
+	s.stopFanoutWorkers()
+	s.fanout = &fanoutWorkers{owner: "a", stop: make(chan struct{})}
+
+	addTestProfile(t, s, "alice")
+	followers := addTestFollowers(t, s, "alice", fanoutBatchSize+10)
+
+	id, err := s.AddItem("alice", time.Time{}, "hello", "", "", "", "text", 0)
+	if err != nil {
+		t.Fatalf("AddItem: %s", err)
+	}
+
+	shard := fanoutShard("alice")
+	rs := s.pdb.Command("RPOPLPUSH", fanoutQueueKey(shard), fanoutProcessingKey(shard))
+	if !rs.IsOK() {
+		t.Fatalf("RPOPLPUSH: %s", rs.Error())
+	}
+	data := rs.ValueAsString()
+
+	// Worker "b" has taken over the shard, so "a" applies nothing and
+	// leaves the job for "b"
+	s.pdb.Command("SET", fanoutLeaseKey(shard), "b")
+	if s.runFanoutJob(shard, data) {
+		t.Fatalf("job finished without the lease")
+	}
+	for _, follower := range followers {
+		if inPossibly(t, s, follower, ItemKey(id)) {
+			t.Fatalf("item added to the timeline of %s without the lease", follower)
+		}
+	}
+	if err := s.WaitForFanout(id, 0); err != ErrFanoutTimeout {
+		t.Errorf("WaitForFanout = %v, want %v", err, ErrFanoutTimeout)
+	}
+
+	// "b" finishes the job once, and "a" can't finish it again
+	b := *s
+	b.fanout = &fanoutWorkers{owner: "b", stop: make(chan struct{})}
+	if !b.runFanoutJob(shard, data) {
+		t.Fatalf("job not finished by the lease holder")
+	}
+	if s.finishFanoutJob(shard, &fanoutJob{Id: "1", ItemId: id}, data, "") {
+		t.Errorf("job finished twice")
+	}
+
+	for _, follower := range followers {
+		if !inPossibly(t, s, follower, ItemKey(id)) {
+			t.Fatalf("item not added to the timeline of %s", follower)
+		}
+	}
+	if err := s.WaitForFanout(id, 0); err != nil {
+		t.Errorf("WaitForFanout = %v", err)
+	}
+	if rs := s.pdb.Command("LLEN", fanoutProcessingKey(shard)); rs.ValueAsString() != "0" {
+		t.Errorf("%s jobs left in the processing list", rs.ValueAsString())
+	}
+}
+
+func TestQueueFanoutFailed(t *testing.T) {
+	s := newTestRedisStore(t)
+	defer s.Close()
+
+	// A key of the wrong type makes queueing the job fail
+	queue := fanoutQueueKey(fanoutShard("alice"))
+	s.pdb.Command("SET", queue, "x")
+	defer s.pdb.Command("DEL", queue)
+
+	if err := s.queueRemoveFromFollowers("alice", "item1"); err == nil {
+		t.Fatalf("queueRemoveFromFollowers succeeded over a string key")
+	}
+	if err := s.WaitForFanout("item1", 0); err != nil {
+		t.Errorf("WaitForFanout = %v for a job that was never queued", err)
+	}
+}
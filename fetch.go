@@ -0,0 +1,227 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotModified    = errors.New("datastore: remote resource not modified")
+	ErrTooLarge       = errors.New("datastore: remote resource too large")
+	ErrPrivateAddress = errors.New("datastore: refusing to fetch from a private address")
+)
+
+// FetchResult is a remote resource read by a Fetcher
+type FetchResult struct {
+	Url          string // after following redirects
+	ContentType  string
+	Body         []byte
+	ETag         string
+	LastModified string
+}
+
+// Fetcher reads remote resources. Fetch only returns resources whose media
+// type is one of accept. When etag or lastModified are given the request is
+// conditional and ErrNotModified is returned if the resource hasn't changed.
+type Fetcher interface {
+	Fetch(url string, accept []string, etag string, lastModified string) (*FetchResult, error)
+}
+
+// Networks that a SafeFetcher won't connect to unless AllowPrivate is set
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+	// IPv4 addresses embedded by NAT64 and 6to4 reach the same hosts as the
+	// addresses themselves
+	"64:ff9b::/96",
+	"2002::/16",
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SafeFetcher fetches resources over http and https within the limits set by
+// its FetchConfig. Unless AllowPrivate is set it refuses to connect to
+// loopback, private and link local addresses, checking the address actually
+// dialled so that redirects and DNS changes can't get around the check.
+type SafeFetcher struct {
+	config FetchConfig
+	client *http.Client
+}
+
+// Fields of config left at zero are taken from DefaultConfig.Fetch
+func NewSafeFetcher(config FetchConfig) *SafeFetcher {
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultConfig.Fetch.Timeout
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = DefaultConfig.Fetch.MaxBytes
+	}
+	if config.MaxRedirects <= 0 {
+		config.MaxRedirects = DefaultConfig.Fetch.MaxRedirects
+	}
+
+	f := &SafeFetcher{config: config}
+
+	timeout := time.Duration(config.Timeout) * time.Second
+	dialer := &net.Dialer{Timeout: timeout}
+
+	transport := &http.Transport{
+		Dial: func(network string, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+
+			ips, err := net.LookupIP(host)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ip := range ips {
+				if config.AllowPrivate || !isPrivateIP(ip) {
+					return dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+				}
+			}
+			return nil, ErrPrivateAddress
+		},
+		ResponseHeaderTimeout: timeout,
+	}
+
+	f.client = &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= config.MaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", len(via))
+			}
+			return checkFetchScheme(req.URL)
+		},
+	}
+
+	return f
+}
+
+func checkFetchScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return Permanent(fmt.Errorf("can't fetch %s urls", u.Scheme))
+	}
+	return nil
+}
+
+func (f *SafeFetcher) Fetch(rawurl string, accept []string, etag string, lastModified string) (*FetchResult, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	if err := checkFetchScheme(u); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, Permanent(err)
+	}
+	req.Header.Set("Accept", strings.Join(accept, ", "))
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		if isPrivateAddressError(err) {
+			return nil, Permanent(ErrPrivateAddress)
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified:
+		return nil, ErrNotModified
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return nil, Permanent(fmt.Errorf("fetching %s: %s", rawurl, resp.Status))
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("fetching %s: %s", rawurl, resp.Status)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !acceptsMediaType(accept, mediaType) {
+		return nil, Permanent(fmt.Errorf("%s has unacceptable content type %q", rawurl, resp.Header.Get("Content-Type")))
+	}
+
+	if resp.ContentLength > f.config.MaxBytes {
+		return nil, Permanent(ErrTooLarge)
+	}
+
+	// Read one byte more than allowed to detect bodies that are too large
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.config.MaxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > f.config.MaxBytes {
+		return nil, Permanent(ErrTooLarge)
+	}
+
+	return &FetchResult{
+		Url:          resp.Request.URL.String(),
+		ContentType:  mediaType,
+		Body:         body,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+func acceptsMediaType(accept []string, mediaType string) bool {
+	for _, a := range accept {
+		if strings.EqualFold(a, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrivateAddressError(err error) bool {
+	return err == ErrPrivateAddress || strings.Contains(err.Error(), ErrPrivateAddress.Error())
+}
@@ -0,0 +1,39 @@
+package datastore
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPrivateIP(t *testing.T) {
+	private := []string{"127.0.0.1", "10.1.2.3", "169.254.169.254", "::1", "fd00::1", "64:ff9b::7f00:1", "2002:7f00:1::1"}
+	for _, addr := range private {
+		if !isPrivateIP(net.ParseIP(addr)) {
+			t.Errorf("%s is not private", addr)
+		}
+	}
+
+	public := []string{"93.184.216.34", "2606:2800:220:1:248:1893:25c8:1946"}
+	for _, addr := range public {
+		if isPrivateIP(net.ParseIP(addr)) {
+			t.Errorf("%s is private", addr)
+		}
+	}
+}
+
+func TestSafeFetcherDefaults(t *testing.T) {
+	srv := newTestPageServer(map[string]string{"/": "<html></html>"}, nil)
+	defer srv.Close()
+
+	f := NewSafeFetcher(FetchConfig{AllowPrivate: true})
+	if f.config.Timeout != DefaultConfig.Fetch.Timeout || f.config.MaxBytes != DefaultConfig.Fetch.MaxBytes || f.config.MaxRedirects != DefaultConfig.Fetch.MaxRedirects {
+		t.Errorf("config = %+v, want the limits of %+v", f.config, DefaultConfig.Fetch)
+	}
+	if f.client.Timeout == 0 {
+		t.Errorf("client has no timeout")
+	}
+
+	if _, err := f.Fetch(srv.URL+"/", pageTypes, "", ""); err != nil {
+		t.Errorf("Fetch: %s", err)
+	}
+}
@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+var ErrNoImageStore = errors.New("datastore: no image store configured")
+
+// Stored images are readable by everyone, such as a web server serving them
+const imageFileMode = 0644
+
+// ImageStore is somewhere cached images are kept. Names returned by Save are
+// what clients use to refer to the image and never contain a slash.
+type ImageStore interface {
+	// Save stores the image written by encode, suggesting key as its name,
+	// and returns the name it was stored under. Nothing is stored if encode
+	// fails.
+	Save(key string, ext string, encode func(w io.Writer) error) (string, error)
+
+	// Open reads a stored image
+	Open(name string) (io.ReadCloser, error)
+
+	Remove(name string) error
+}
+
+// LocalImageStore keeps images in a directory named by the key they were
+// saved with
+type LocalImageStore struct {
+	Dir string
+}
+
+func NewLocalImageStore(dir string) *LocalImageStore {
+	return &LocalImageStore{Dir: dir}
+}
+
+func (s *LocalImageStore) Save(key string, ext string, encode func(w io.Writer) error) (string, error) {
+	name := key + "." + ext
+	if _, err := writeImageFile(s.Dir, name, nil, encode); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (s *LocalImageStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.Dir, filepath.Base(name)))
+}
+
+func (s *LocalImageStore) Remove(name string) error {
+	return os.Remove(filepath.Join(s.Dir, filepath.Base(name)))
+}
+
+// ContentImageStore keeps images in a directory named by the SHA-256 of their
+// content so that identical images are only stored once
+type ContentImageStore struct {
+	Dir string
+}
+
+func NewContentImageStore(dir string) *ContentImageStore {
+	return &ContentImageStore{Dir: dir}
+}
+
+func (s *ContentImageStore) Save(key string, ext string, encode func(w io.Writer) error) (string, error) {
+	hasher := sha256.New()
+
+	tmp, err := writeImageFile(s.Dir, "", hasher, encode)
+	if err != nil {
+		return "", err
+	}
+
+	name := fmt.Sprintf("%x.%s", hasher.Sum(nil), ext)
+	if err := os.Rename(tmp, filepath.Join(s.Dir, name)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return name, nil
+}
+
+func (s *ContentImageStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.Dir, filepath.Base(name)))
+}
+
+func (s *ContentImageStore) Remove(name string) error {
+	return os.Remove(filepath.Join(s.Dir, filepath.Base(name)))
+}
+
+// writeImageFile encodes an image into a temporary file in dir, also writing
+// it to hasher if given. The file is renamed to name once it has been
+// completely written. When name is empty the temporary file is left for the
+// caller to rename and its path is returned. Temporary files are created
+// readable only by their owner, so the file is given imageFileMode first.
+func writeImageFile(dir string, name string, hasher hash.Hash, encode func(w io.Writer) error) (string, error) {
+	f, err := ioutil.TempFile(dir, ".img-")
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+
+	var w io.Writer = f
+	if hasher != nil {
+		w = io.MultiWriter(f, hasher)
+	}
+
+	bw := bufio.NewWriter(w)
+	err = encode(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Chmod(imageFileMode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if name == "" {
+		return tmp, nil
+	}
+
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return name, nil
+}
+
+// Fetches the image at url, crops it to the banner size and saves it in
+// images. Returns the name of the stored image, or url if it could not be
+// cached.
+func CacheImage(url string, images ImageStore) (string, error) {
+	config := DefaultConfig.Images
+	config.Variants = []ImageVariant{BannerVariant}
+
+	cached, err := CacheImageVariants(url, NewSafeFetcher(DefaultConfig.Fetch), images, config, nil)
+	if err != nil {
+		return url, err
+	}
+
+	return cached.Variants[BannerVariant.Name], nil
+}
@@ -0,0 +1,37 @@
+package datastore
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageStoreFileMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	encode := func(w io.Writer) error {
+		_, err := w.Write([]byte("image"))
+		return err
+	}
+
+	for _, store := range []ImageStore{NewLocalImageStore(dir), NewContentImageStore(dir)} {
+		name, err := store.Save("key", "png", encode)
+		if err != nil {
+			t.Fatalf("Save: %s", err)
+		}
+
+		fi, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Stat: %s", err)
+		}
+		if mode := fi.Mode().Perm(); mode != imageFileMode {
+			t.Errorf("%T saved %s with mode %o, want %o", store, name, mode, imageFileMode)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Items needing images are claimed by moving them from ITEMS_NEEDING_IMAGES
+// to a sorted set scored by when the claim lapses. A claim that lapses
+// because its worker died returns the item to the set. Failed items are left
+// claimed until their next attempt is due so the same mechanism provides the
+// retry backoff.
+
+const (
+	ITEMS_CLAIMED_FOR_IMAGES = "itemsclaimedforimages"
+	IMAGE_ATTEMPTS           = "imageattempts"
+	IMAGE_FAILURES           = "imagefailures"
+
+	imagePollTimeout = 1  // seconds
+	imageRetryDelay  = 30 // seconds, doubled after each attempt
+)
+
+// When a host may next be fetched from, in unix milliseconds
+func imageHostKey(host string) string {
+	return fmt.Sprintf("imagehost:%s", host)
+}
+
+// ImageProcessor finds and caches the image for an item. Errors are retried
+// unless wrapped with Permanent.
+type ImageProcessor func(item *Item) error
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Permanent marks an error as one that won't be fixed by trying again
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func isPermanent(err error) bool {
+	_, ok := err.(*permanentError)
+	return ok
+}
+
+type ImageFailure struct {
+	Id       ItemIdType `json:"id"`
+	Error    string     `json:"error"`
+	Attempts int        `json:"attempts"`
+	Failed   int64      `json:"failed"`
+}
+
+// imageWorkers tracks the image workers started by a store
+type imageWorkers struct {
+	process ImageProcessor
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Moves an item from the set needing images into the claimed set.
+// KEYS: needing images, claimed
+// ARGV: claim expiry
+var claimImageItemScript = newLuaScript(`
+local id = redis.call('SPOP', KEYS[1])
+if not id then
+	return false
+end
+redis.call('ZADD', KEYS[2], ARGV[1], id)
+return id
+`)
+
+// Returns items whose claim has lapsed to the set needing images.
+// KEYS: needing images, claimed
+// ARGV: now
+var releaseImageItemsScript = newLuaScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, id in ipairs(ids) do
+	redis.call('SADD', KEYS[1], id)
+	redis.call('ZREM', KEYS[2], id)
+end
+return #ids
+`)
+
+// Reserves the next slot for a request to a host, returning the number of
+// milliseconds until it. The key lapses once the slot has passed.
+// KEYS: host
+// ARGV: now, interval in milliseconds
+var reserveImageHostScript = newLuaScript(`
+local now = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local next = tonumber(redis.call('GET', KEYS[1])) or now
+if next < now then
+	next = now
+end
+redis.call('SET', KEYS[1], next + interval, 'PX', next + interval - now)
+return next - now
+`)
+
+// Starts workers that fetch images for items added with a link but no image,
+// passing each to process. The number of workers, the claim lease, the number
+// of attempts and the minimum interval between requests to the same host are
+// set by Config.Imager. Workers in several processes can share the same
+// databases, and the interval between requests to a host is kept across all
+// of them. The workers are stopped by Close.
+func (s *RedisStore) StartImageWorkers(process ImageProcessor) error {
+	if s.imager != nil {
+		return fmt.Errorf("image workers already started")
+	}
+
+	s.imager = &imageWorkers{
+		process: process,
+		stop:    make(chan struct{}),
+	}
+
+	s.imager.wg.Add(1)
+	go s.releaseImageItems()
+
+	for i := 0; i < s.config.Imager.Workers; i++ {
+		s.imager.wg.Add(1)
+		go s.imageWorker()
+	}
+
+	return nil
+}
+
+func (s *RedisStore) stopImageWorkers() {
+	if s.imager == nil {
+		return
+	}
+	close(s.imager.stop)
+	s.imager.wg.Wait()
+	s.imager = nil
+}
+
+// Waits for d, reporting false if the workers were stopped first
+func (w *imageWorkers) sleep(d time.Duration) bool {
+	select {
+	case <-w.stop:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// Waits until a request may be made to host by any worker sharing the
+// databases, reporting false if the workers were stopped first
+func (s *RedisStore) waitForHost(host string, interval time.Duration) bool {
+	if interval <= 0 {
+		return true
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	rs := reserveImageHostScript.run(s.pdb, []string{imageHostKey(host)}, now, int64(interval/time.Millisecond))
+	if !rs.IsOK() {
+		// Better to fetch a little too often than not at all
+		applog.Errorf("Could not reserve a request to %s: %s", host, rs.Error().Error())
+		return true
+	}
+
+	wait, _ := rs.ValueAsInt64()
+	return s.imager.sleep(time.Duration(wait) * time.Millisecond)
+}
+
+func (s *RedisStore) releaseImageItems() {
+	defer s.imager.wg.Done()
+
+	for s.imager.sleep(imagePollTimeout * time.Second) {
+		rs := releaseImageItemsScript.run(s.pdb, []string{ITEMS_NEEDING_IMAGES, ITEMS_CLAIMED_FOR_IMAGES}, time.Now().Unix())
+		if !rs.IsOK() {
+			applog.Errorf("Could not release lapsed image claims: %s", rs.Error().Error())
+		}
+	}
+}
+
+func (s *RedisStore) imageWorker() {
+	defer s.imager.wg.Done()
+
+	for {
+		id, err := s.claimImageItem()
+		if err != nil {
+			if !isKeyNotFound(err) {
+				applog.Errorf("Could not claim item needing an image: %s", err.Error())
+			}
+			if !s.imager.sleep(imagePollTimeout * time.Second) {
+				return
+			}
+			continue
+		}
+
+		if !s.processImageItem(id) {
+			return
+		}
+	}
+}
+
+func (s *RedisStore) claimImageItem() (ItemIdType, error) {
+	expiry := time.Now().Unix() + int64(s.config.Imager.Lease)
+
+	rs := claimImageItemScript.run(s.pdb, []string{ITEMS_NEEDING_IMAGES, ITEMS_CLAIMED_FOR_IMAGES}, expiry)
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	return ItemIdType(rs.ValueAsString()), nil
+}
+
+// Processes a claimed item, reporting false if the workers were stopped
+// before it could be processed
+func (s *RedisStore) processImageItem(id ItemIdType) bool {
+	item, err := s.Item(id)
+	if err != nil {
+		if isKeyNotFound(err) {
+			s.finishImageItem(id)
+		} else {
+			s.failImageItem(id, err)
+		}
+		return true
+	}
+
+	if item.Link == "" || item.Image != "" {
+		s.finishImageItem(id)
+		return true
+	}
+
+	if link, err := url.Parse(item.Link); err == nil {
+		interval := time.Duration(s.config.Imager.HostInterval) * time.Millisecond
+		if !s.waitForHost(link.Host, interval) {
+			// Leave the claim to lapse so the item is picked up again
+			return false
+		}
+	}
+
+	if err := s.imager.process(item); err != nil {
+		s.failImageItem(id, err)
+		return true
+	}
+
+	s.finishImageItem(id)
+	return true
+}
+
+func (s *RedisStore) finishImageItem(id ItemIdType) {
+	rs := s.pdb.Command("ZREM", ITEMS_CLAIMED_FOR_IMAGES, id)
+	if !rs.IsOK() {
+		applog.Errorf("Could not remove image claim for %s: %s", id, rs.Error().Error())
+	}
+
+	s.pdb.Command("HDEL", IMAGE_ATTEMPTS, id)
+}
+
+// Schedules another attempt at the item after a delay, or records it as
+// failed once it has run out of attempts
+func (s *RedisStore) failImageItem(id ItemIdType, err error) {
+	rs := s.pdb.Command("HINCRBY", IMAGE_ATTEMPTS, id, 1)
+	if !rs.IsOK() {
+		applog.Errorf("Could not count image attempts for %s: %s", id, rs.Error().Error())
+		return
+	}
+	attempts, _ := rs.ValueAsInt()
+
+	applog.Errorf("Image fetch for %s failed on attempt %d: %s", id, attempts, err.Error())
+
+	if !isPermanent(err) && attempts < s.config.Imager.Attempts {
+		retry := time.Now().Unix() + int64(imageRetryDelay<<uint(attempts-1))
+		rs = s.pdb.Command("ZADD", ITEMS_CLAIMED_FOR_IMAGES, retry, id)
+		if !rs.IsOK() {
+			applog.Errorf("Could not schedule image retry for %s: %s", id, rs.Error().Error())
+		}
+		return
+	}
+
+	failure, _ := json.Marshal(&ImageFailure{Id: id, Error: err.Error(), Attempts: attempts, Failed: time.Now().Unix()})
+	rs = s.pdb.Command("HSET", IMAGE_FAILURES, id, failure)
+	if !rs.IsOK() {
+		applog.Errorf("Could not record image failure for %s: %s", id, rs.Error().Error())
+	}
+
+	s.finishImageItem(id)
+}
+
+// Lists the items whose image could not be fetched
+func (s *RedisStore) ImageFailures() ([]*ImageFailure, error) {
+	failures := make([]*ImageFailure, 0)
+
+	rs := s.pdb.Command("HVALS", IMAGE_FAILURES)
+	if !rs.IsOK() {
+		return failures, rs.Error()
+	}
+
+	for _, val := range rs.ValuesAsStrings() {
+		failure := &ImageFailure{}
+		if err := json.Unmarshal([]byte(val), failure); err == nil {
+			failures = append(failures, failure)
+		}
+	}
+
+	return failures, nil
+}
+
+// Clears the recorded failure for an item and queues it to be tried again
+func (s *RedisStore) RetryImageFailure(id ItemIdType) error {
+	rs := s.pdb.Command("HDEL", IMAGE_FAILURES, id)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	rs = s.pdb.Command("SADD", ITEMS_NEEDING_IMAGES, id)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
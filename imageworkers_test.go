@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestImageHostInterval(t *testing.T) {
+	s := newTestRedisStore(t)
+	defer s.Close()
+
+	// A second process sharing the same databases
+	other, err := NewRedisStore(testRedisConfig(t), nil)
+	if err != nil {
+		t.Fatalf("NewRedisStore: %s", err)
+	}
+	defer other.Close()
+
+	for _, store := range []*RedisStore{s, other} {
+		store.imager = &imageWorkers{stop: make(chan struct{})}
+	}
+
+	const interval = 300 * time.Millisecond
+
+	start := time.Now()
+	if !s.waitForHost("example.com", interval) {
+		t.Fatalf("waitForHost stopped")
+	}
+	if waited := time.Since(start); waited >= interval {
+		t.Errorf("first request waited %s", waited)
+	}
+
+	if !other.waitForHost("example.com", interval) {
+		t.Fatalf("waitForHost stopped")
+	}
+	if waited := time.Since(start); waited < interval*9/10 {
+		t.Errorf("second request from another process waited %s, want %s", waited, interval)
+	}
+
+	// Other hosts aren't held up
+	start = time.Now()
+	if !other.waitForHost("example.org", interval) {
+		t.Fatalf("waitForHost stopped")
+	}
+	if waited := time.Since(start); waited >= interval {
+		t.Errorf("request to another host waited %s", waited)
+	}
+}
+
+func TestImagerDefaults(t *testing.T) {
+	config := testConfig("")
+	config.Imager = ImagerConfig{}
+
+	want := DefaultConfig.Imager
+	want.HostInterval = 0
+	if c := NewMemoryStore(config, nil).config.Imager; c != want {
+		t.Errorf("imager config = %+v, want %+v", c, want)
+	}
+}
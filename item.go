@@ -6,24 +6,27 @@ import (
 )
 
 type TimelineRange struct {
-	Pid    string    `json:"pid"`
-	PName  string    `json:"pname,omitempty"`
-	Tstart time.Time `json:"tstart"`
-	Tend   time.Time `json:"tend"`
-	Items  []*Item   `json:"items"`
+	Pid    string           `json:"pid"`
+	PName  string           `json:"pname,omitempty"`
+	Tstart time.Time        `json:"tstart"`
+	Tend   time.Time        `json:"tend"`
+	Items  []*FormattedItem `json:"items"`
+	Next   string           `json:"next,omitempty"`
+	Prev   string           `json:"prev,omitempty"`
 }
 
 type Item struct {
-	Id       ItemIdType `json:"id"`
-	Added    int64      `json:"added"`
-	Event    int64      `json:"event"`
-	Pid      PidType    `json:"pid"`
-	PName    string     `json:"name,omitempty"`
-	Text     string     `json:"text"`
-	Link     string     `json:"link"`
-	Media    string     `json:"media"`
-	Image    string     `json:"image"`
-	Duration int        `json:"duration"` // always in seconds
+	Id       ItemIdType        `json:"id"`
+	Added    int64             `json:"added"`
+	Event    int64             `json:"event"`
+	Pid      PidType           `json:"pid"`
+	PName    string            `json:"name,omitempty"`
+	Text     string            `json:"text"`
+	Link     string            `json:"link"`
+	Media    string            `json:"media"`
+	Image    string            `json:"image"`
+	Images   map[string]string `json:"images,omitempty"` // cached image variants by name
+	Duration int               `json:"duration"`         // always in seconds
 }
 
 type FormattedItem struct {
@@ -41,6 +44,18 @@ type FormattedItem struct {
 // 	return fitem
 // }
 
+func newFormattedItem(item *Item, ts int64) *FormattedItem {
+	fitem := &FormattedItem{Item: *item, Ts: ts}
+	fitem.Added = item.Added / 1000000000
+	fitem.Event = item.Event / 1000000000
+	return fitem
+}
+
+// Reports whether an item reached pid's timeline via a third profile
+func isVia(source PidType, item *Item, pid PidType) bool {
+	return source != PidType("") && source != item.Pid && source != pid
+}
+
 func (i *Item) String() string {
 	return fmt.Sprintf("Title: %sLink: %s", i.Text, i.Link)
 }
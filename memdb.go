@@ -0,0 +1,489 @@
+package datastore
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrKeyNotFound = errors.New("datastore: key not found")
+
+// memDatabase is an in-process stand in for a single redis database. It only
+// implements the data types and operations used by the datastore.
+type memDatabase struct {
+	mu      sync.Mutex
+	strings map[string]string
+	hashes  map[string]map[string]string
+	sets    map[string]map[string]bool
+	zsets   map[string]map[string]float64
+	expires map[string]time.Time
+}
+
+func newMemDatabase() *memDatabase {
+	db := &memDatabase{}
+	db.flush()
+	return db
+}
+
+func (db *memDatabase) flush() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.strings = make(map[string]string)
+	db.hashes = make(map[string]map[string]string)
+	db.sets = make(map[string]map[string]bool)
+	db.zsets = make(map[string]map[string]float64)
+	db.expires = make(map[string]time.Time)
+}
+
+// expireKey removes the key if its lifetime has passed. Must be called with the lock held.
+func (db *memDatabase) expireKey(key string) {
+	if t, exists := db.expires[key]; exists && !time.Now().Before(t) {
+		db.delKey(key)
+	}
+}
+
+// delKey must be called with the lock held
+func (db *memDatabase) delKey(key string) bool {
+	_, s := db.strings[key]
+	_, h := db.hashes[key]
+	_, st := db.sets[key]
+	_, z := db.zsets[key]
+	delete(db.strings, key)
+	delete(db.hashes, key)
+	delete(db.sets, key)
+	delete(db.zsets, key)
+	delete(db.expires, key)
+	return s || h || st || z
+}
+
+func (db *memDatabase) del(keys ...string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n := 0
+	for _, key := range keys {
+		if db.delKey(key) {
+			n++
+		}
+	}
+	return n
+}
+
+func (db *memDatabase) exists(key string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	_, s := db.strings[key]
+	_, h := db.hashes[key]
+	_, st := db.sets[key]
+	_, z := db.zsets[key]
+	return s || h || st || z
+}
+
+func (db *memDatabase) keys(match func(key string) bool) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	found := make(map[string]bool)
+	collect := func(key string) {
+		if t, exists := db.expires[key]; exists && !time.Now().Before(t) {
+			return
+		}
+		if match(key) {
+			found[key] = true
+		}
+	}
+	for key := range db.strings {
+		collect(key)
+	}
+	for key := range db.hashes {
+		collect(key)
+	}
+	for key := range db.sets {
+		collect(key)
+	}
+	for key := range db.zsets {
+		collect(key)
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the keys of the hashes that match, in order
+func (db *memDatabase) hashKeys(match func(key string) bool) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	keys := make([]string, 0)
+	for key := range db.hashes {
+		if t, exists := db.expires[key]; exists && !time.Now().Before(t) {
+			continue
+		}
+		if match(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (db *memDatabase) expire(key string, lifetime time.Duration) {
+	if !db.exists(key) {
+		return
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expires[key] = time.Now().Add(lifetime)
+}
+
+// Reports whether the key exists and has a lifetime set
+func (db *memDatabase) hasExpiry(key string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	_, exists := db.expires[key]
+	return exists
+}
+
+// The remaining lifetime of the key, or zero if it doesn't exist or has none
+func (db *memDatabase) ttl(key string) time.Duration {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	if t, exists := db.expires[key]; exists {
+		return t.Sub(time.Now())
+	}
+	return 0
+}
+
+func (db *memDatabase) persist(key string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.expires, key)
+}
+
+func (db *memDatabase) get(key string) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	val, exists := db.strings[key]
+	if !exists {
+		return "", ErrKeyNotFound
+	}
+	return val, nil
+}
+
+func (db *memDatabase) set(key string, val string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.delKey(key)
+	db.strings[key] = val
+}
+
+func (db *memDatabase) incr(key string) int64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	n, _ := strconv.ParseInt(db.strings[key], 10, 64)
+	n++
+	db.strings[key] = strconv.FormatInt(n, 10)
+	return n
+}
+
+// Gets a string and deletes it in one step
+func (db *memDatabase) getdel(key string) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	val, exists := db.strings[key]
+	if !exists {
+		return "", ErrKeyNotFound
+	}
+	db.delKey(key)
+	return val, nil
+}
+
+func (db *memDatabase) hget(key string, field string) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	val, exists := db.hashes[key][field]
+	if !exists {
+		return "", ErrKeyNotFound
+	}
+	return val, nil
+}
+
+func (db *memDatabase) hgetall(key string) map[string]string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	vals := make(map[string]string, len(db.hashes[key]))
+	for k, v := range db.hashes[key] {
+		vals[k] = v
+	}
+	return vals
+}
+
+func (db *memDatabase) hmset(key string, vals map[string]string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	h, exists := db.hashes[key]
+	if !exists {
+		h = make(map[string]string)
+		db.hashes[key] = h
+	}
+	for k, v := range vals {
+		h[k] = v
+	}
+}
+
+func (db *memDatabase) hset(key string, field string, val string) {
+	db.hmset(key, map[string]string{field: val})
+}
+
+// Sets field to val unless it is already set, reporting whether it was set
+func (db *memDatabase) hsetnx(key string, field string, val string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	if _, exists := db.hashes[key][field]; exists {
+		return false
+	}
+	if db.hashes[key] == nil {
+		db.hashes[key] = make(map[string]string)
+	}
+	db.hashes[key][field] = val
+	return true
+}
+
+// Sets field to val if it currently holds old, reporting whether it was set
+func (db *memDatabase) hsetIfEqual(key string, field string, old string, val string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	if cur, exists := db.hashes[key][field]; !exists || cur != old {
+		return false
+	}
+	db.hashes[key][field] = val
+	return true
+}
+
+func (db *memDatabase) hdel(key string, field string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	delete(db.hashes[key], field)
+	if len(db.hashes[key]) == 0 {
+		delete(db.hashes, key)
+	}
+}
+
+func (db *memDatabase) sadd(key string, member string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	s, exists := db.sets[key]
+	if !exists {
+		s = make(map[string]bool)
+		db.sets[key] = s
+	}
+	s[member] = true
+}
+
+func (db *memDatabase) srem(key string, member string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	delete(db.sets[key], member)
+	if len(db.sets[key]) == 0 {
+		delete(db.sets, key)
+	}
+}
+
+func (db *memDatabase) sismember(key string, member string) bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	return db.sets[key][member]
+}
+
+// smembers returns the members of the set in lexical order
+func (db *memDatabase) smembers(key string) []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	members := make([]string, 0, len(db.sets[key]))
+	for member := range db.sets[key] {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+func (db *memDatabase) scard(key string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	return len(db.sets[key])
+}
+
+// spop removes and returns a random member of the set
+func (db *memDatabase) spop(key string) (string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	s := db.sets[key]
+	if len(s) == 0 {
+		return "", ErrKeyNotFound
+	}
+	n := rand.Intn(len(s))
+	for member := range s {
+		if n == 0 {
+			delete(s, member)
+			if len(s) == 0 {
+				delete(db.sets, key)
+			}
+			return member, nil
+		}
+		n--
+	}
+	return "", ErrKeyNotFound
+}
+
+func (db *memDatabase) zadd(key string, score float64, member string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	z, exists := db.zsets[key]
+	if !exists {
+		z = make(map[string]float64)
+		db.zsets[key] = z
+	}
+	z[member] = score
+}
+
+func (db *memDatabase) zincrby(key string, incr float64, member string) float64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	z, exists := db.zsets[key]
+	if !exists {
+		z = make(map[string]float64)
+		db.zsets[key] = z
+	}
+	z[member] += incr
+	return z[member]
+}
+
+func (db *memDatabase) zscore(key string, member string) (float64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	score, exists := db.zsets[key][member]
+	if !exists {
+		return 0, ErrKeyNotFound
+	}
+	return score, nil
+}
+
+func (db *memDatabase) zrem(key string, member string) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	delete(db.zsets[key], member)
+	if len(db.zsets[key]) == 0 {
+		delete(db.zsets, key)
+	}
+}
+
+func (db *memDatabase) zcard(key string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	return len(db.zsets[key])
+}
+
+func (db *memDatabase) zcount(key string, r scoreRange) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.expireKey(key)
+	n := 0
+	for _, score := range db.zsets[key] {
+		if r.contains(score) {
+			n++
+		}
+	}
+	return n
+}
+
+// sorted returns the members of a sorted set ordered by score then member,
+// in the same order as redis. Must be called with the lock held.
+func (db *memDatabase) sorted(key string) []scoredMember {
+	db.expireKey(key)
+	members := make([]scoredMember, 0, len(db.zsets[key]))
+	for member, score := range db.zsets[key] {
+		members = append(members, scoredMember{member: member, score: score})
+	}
+	sort.Sort(byScore(members))
+	return members
+}
+
+// zrange follows the index semantics of ZRANGE, including an inclusive stop
+func (db *memDatabase) zrange(key string, start int, stop int) []scoredMember {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	members := db.sorted(key)
+	n := len(members)
+	if start < 0 {
+		start += n
+		if start < 0 {
+			start = 0
+		}
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start >= n || start > stop {
+		return []scoredMember{}
+	}
+	return members[start : stop+1]
+}
+
+// zrangeByScore follows the semantics of ZRANGEBYSCORE and ZREVRANGEBYSCORE
+// with a LIMIT clause. A negative count returns all matching members.
+func (db *memDatabase) zrangeByScore(key string, r scoreRange, offset int, count int, reverse bool) []scoredMember {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	members := db.sorted(key)
+	if reverse {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+
+	found := make([]scoredMember, 0)
+	for _, m := range members {
+		if count >= 0 && len(found) >= count {
+			break
+		}
+		if !r.contains(m.score) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		found = append(found, m)
+	}
+	return found
+}
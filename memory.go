@@ -0,0 +1,770 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-memory implementation of Store. It uses the same key
+// layout as RedisStore and is intended for tests that cannot rely on a running
+// redis server.
+type MemoryStore struct {
+	tdb     *memDatabase
+	idb     *memDatabase
+	pdb     *memDatabase
+	sdb     *memDatabase
+	config  Config
+	images  ImageStore
+	fetcher Fetcher
+
+	// Makes changes to a timeline and its sources atomic
+	timelineMu sync.Mutex
+}
+
+func NewMemoryStore(config Config, images ImageStore) *MemoryStore {
+	config = config.withDefaults()
+	return &MemoryStore{
+		tdb:     newMemDatabase(),
+		idb:     newMemDatabase(),
+		pdb:     newMemDatabase(),
+		sdb:     newMemDatabase(),
+		config:  config,
+		images:  images,
+		fetcher: NewSafeFetcher(config.Fetch),
+	}
+}
+
+func (s *MemoryStore) Close() {
+
+}
+
+func (s *MemoryStore) SetFetcher(fetcher Fetcher) {
+	s.fetcher = fetcher
+}
+
+func (s *MemoryStore) SuggestedProfiles(loc string) ([]*Profile, error) {
+	profiles := make([]*Profile, 0)
+
+	for _, pid := range s.pdb.smembers(suggestedProfileKey(loc)) {
+		profile, err := s.Profile(PidType(pid))
+		if err != nil {
+			continue
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+func (s *MemoryStore) AddSuggestedProfile(pid PidType, loc string) error {
+	s.pdb.sadd(SUGGESTED_LOCATIONS, loc)
+	s.pdb.sadd(suggestedProfileKey(loc), string(pid))
+	return nil
+}
+
+func (s *MemoryStore) RemoveSuggestedProfile(pid PidType, loc string) error {
+	s.pdb.srem(suggestedProfileKey(loc), string(pid))
+	return nil
+}
+
+// The pids of every profile, skipping other keys that end in ":info"
+func (s *MemoryStore) profilePids() []PidType {
+	keys := s.pdb.hashKeys(func(key string) bool {
+		return strings.HasSuffix(key, ":info")
+	})
+
+	pids := make([]PidType, 0, len(keys))
+	for _, key := range keys {
+		pids = append(pids, pidFromKey(key))
+	}
+	return pids
+}
+
+func (s *MemoryStore) ProfileExists(pid PidType) (bool, error) {
+	return s.pdb.exists(string(profileKey(pid))), nil
+}
+
+func (s *MemoryStore) Profile(pid PidType) (*Profile, error) {
+	p := profileFromHash(pid, s.pdb.hgetall(string(profileKey(pid))))
+
+	p.PossiblyCount = s.tdb.zcard(possiblyKey(pid, ORDERING_TS))
+	p.MaybeCount = s.tdb.zcard(maybeKey(pid, ORDERING_TS))
+	p.FollowingCount = s.pdb.zcard(followingKey(pid))
+	p.FollowerCount = s.pdb.zcard(followersKey(pid))
+	p.FeedCount = s.pdb.scard(feedsKey(pid))
+
+	return p, nil
+}
+
+func (s *MemoryStore) BriefProfile(pid PidType) (*BriefProfile, error) {
+	return briefProfileFromHash(pid, s.pdb.hgetall(string(profileKey(pid)))), nil
+}
+
+func (s *MemoryStore) AddProfile(pid PidType, password string, pname string, bio string, feedtype string, feedurl string, parentpid PidType, email string, location string, url string, profileImageUrl string, profileImageUrlHttps string, itemType string) error {
+	pwdhash, err := hashPassword(password, s.config.Passwords)
+	if err != nil {
+		return err
+	}
+
+	if err := s.indexEmail(pid, email); err != nil {
+		return err
+	}
+
+	s.pdb.hmset(string(profileKey(pid)), profileCodec.encode(&Profile{
+		Name:                 pname,
+		PasswordHash:         pwdhash,
+		Bio:                  bio,
+		Email:                email,
+		Joined:               time.Now().Unix(),
+		Location:             location,
+		Url:                  url,
+		ProfileImageUrl:      profileImageUrl,
+		ProfileImageUrlHttps: profileImageUrlHttps,
+		FeedType:             feedtype,
+		FeedUrl:              feedurl,
+		ParentPid:            parentpid,
+		ItemType:             itemType,
+	}))
+
+	if feedurl != "" {
+		s.pdb.sadd(FEED_DRIVEN_PROFILES, string(pid))
+	}
+	if parentpid != "" {
+		s.pdb.sadd(feedsKey(parentpid), string(pid))
+	}
+
+	s.indexProfile(pid)
+	return nil
+}
+
+func (s *MemoryStore) UpdateProfile(pid PidType, values map[string]string) error {
+	if err := profileCodec.validate(values); err != nil {
+		return err
+	}
+
+	if len(values) == 0 {
+		return nil
+	}
+
+	email, changingEmail := values["email"]
+	oldEmail, _ := s.pdb.hget(string(profileKey(pid)), "email")
+	oldParent, _ := s.pdb.hget(string(profileKey(pid)), "parentpid")
+	if changingEmail {
+		if err := s.indexEmail(pid, email); err != nil {
+			return err
+		}
+	}
+
+	s.pdb.hmset(string(profileKey(pid)), values)
+
+	if changingEmail {
+		s.changeEmail(pid, oldEmail, email)
+	}
+
+	if feedurl, exists := values["feedurl"]; exists && feedurl != "" {
+		s.pdb.sadd(FEED_DRIVEN_PROFILES, string(pid))
+	}
+
+	if parentpid, exists := values["parentpid"]; exists && parentpid != oldParent {
+		if oldParent != "" {
+			s.pdb.srem(feedsKey(PidType(oldParent)), string(pid))
+		}
+		if parentpid != "" {
+			s.pdb.sadd(feedsKey(PidType(parentpid)), string(pid))
+		}
+	}
+
+	if indexedChange(values) {
+		s.indexProfile(pid)
+	}
+
+	return nil
+}
+
+// Removes the profile and everything that refers to it. See DeleteProfile.
+func (s *MemoryStore) RemoveProfile(pid PidType) error {
+	_, err := s.DeleteProfile(pid)
+	return err
+}
+
+func (s *MemoryStore) FlagProfile(pid PidType) error {
+	s.pdb.zincrby(FLAGGED_PROFILES, 1.0, string(pid))
+	return nil
+}
+
+func (s *MemoryStore) FlaggedProfiles(start int, count int) ([]*ScoredProfile, error) {
+	profiles := make([]*ScoredProfile, 0)
+
+	for _, m := range s.pdb.zrange(FLAGGED_PROFILES, start, start+count) {
+		profiles = append(profiles, &ScoredProfile{Pid: m.member, Score: m.score})
+	}
+
+	return profiles, nil
+}
+
+func (s *MemoryStore) FeedDrivenProfiles() ([]*Profile, error) {
+	profiles := make([]*Profile, 0)
+
+	for _, pid := range s.pdb.smembers(FEED_DRIVEN_PROFILES) {
+		profile, err := s.Profile(PidType(pid))
+		if err != nil {
+			applog.Errorf("Unable to read profile %s from store: %s", pid, err.Error())
+			continue
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+func (s *MemoryStore) TimelineRange(pid PidType, status string, ts time.Time, before int, after int) ([]*FormattedItem, error) {
+	score := itemScore(ts)
+	timelineKey := timelineKey(pid, status)
+
+	members := make([]scoredMember, 0)
+
+	if after > 0 {
+		vals, _ := s.scanTimeline(timelineKey, scoreRange{min: score, max: math.Inf(1)}, after, false)
+		for i := len(vals) - 1; i >= 0; i-- {
+			members = append(members, vals[i])
+		}
+	}
+
+	// Don't include duplicate item
+	r := scoreRange{min: math.Inf(-1), max: score, maxExclusive: len(members) > 0}
+	vals, _ := s.scanTimeline(timelineKey, r, before+1, true)
+	members = append(members, vals...)
+
+	return s.formatTimelineItems(pid, members)
+}
+
+// Gets a page of pid's timeline, newest first, starting from the position
+// encoded in cursor. An empty cursor starts from the newest item.
+func (s *MemoryStore) TimelinePage(pid PidType, status string, cursor string, count int) (*TimelineRange, error) {
+	members, next, prev, err := timelinePage(s, timelineKey(pid, status), cursor, count)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.formatTimelineItems(pid, members)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTimelineRange(pid, items, next, prev), nil
+}
+
+// Gets the items in pid's timeline scheduled in the window [tstart, tend),
+// earliest first. A limit of zero or less returns every item in the window.
+func (s *MemoryStore) TimelineWindow(pid PidType, status string, tstart time.Time, tend time.Time, limit int) (*TimelineRange, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	members, _ := s.scanTimeline(timelineKey(pid, status), timelineWindow(tstart, tend), limit, false)
+
+	items, err := s.formatTimelineItems(pid, members)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TimelineRange{
+		Pid:    string(pid),
+		Tstart: tstart,
+		Tend:   tend,
+		Items:  items,
+	}, nil
+}
+
+// Counts the items in pid's timeline scheduled in the window [tstart, tend)
+func (s *MemoryStore) TimelineWindowCount(pid PidType, status string, tstart time.Time, tend time.Time) (int, error) {
+	return s.tdb.zcount(timelineKey(pid, status), timelineWindow(tstart, tend)), nil
+}
+
+func (s *MemoryStore) scanTimeline(timelineKey string, r scoreRange, count int, reverse bool) ([]scoredMember, error) {
+	return s.tdb.zrangeByScore(timelineKey, r, 0, count, reverse), nil
+}
+
+// Loads and formats the items in a timeline, skipping any that no longer exist
+func (s *MemoryStore) formatTimelineItems(pid PidType, members []scoredMember) ([]*FormattedItem, error) {
+	items := make([]*FormattedItem, 0, len(members))
+
+	for _, m := range members {
+		item, err := s.ItemByKey(m.member)
+		if err != nil {
+			applog.Errorf("Could not get key %s from db: %s", m.member, err.Error())
+			continue
+		}
+
+		fitem, err := s.FormatItem(item, int64(m.score), pid)
+		if err != nil {
+			applog.Errorf("Could not format item: %s", err.Error())
+			continue
+		}
+		items = append(items, fitem)
+	}
+
+	return items, nil
+}
+
+// Gets an item as it appears in a timeline
+func (s *MemoryStore) ItemInTimeline(item *Item, pid PidType, status string) ([]*FormattedItem, error) {
+	items := make([]*FormattedItem, 0)
+
+	var timelineKey string
+	if status == "p" {
+		timelineKey = possiblyKey(pid, "ts")
+	} else {
+		timelineKey = maybeKey(pid, "ts")
+	}
+
+	ts := s.ItemScore(item.Key(), timelineKey)
+
+	fitem, err := s.FormatItem(item, ts, pid)
+	if err != nil {
+		return items, err
+	}
+
+	items = append(items, fitem)
+
+	return items, nil
+}
+
+func (s *MemoryStore) FormatItem(item *Item, ts int64, pid PidType) (*FormattedItem, error) {
+	source, _ := s.tdb.hget(sourcesKey(pid), item.Key())
+
+	fitem := newFormattedItem(item, ts)
+
+	aprofile, err := s.BriefProfile(item.Pid)
+	if err != nil {
+		return nil, err
+	}
+	fitem.Author = aprofile
+
+	if isVia(PidType(source), item, pid) {
+		sprofile, err := s.BriefProfile(PidType(source))
+		if err != nil {
+			return nil, err
+		}
+		fitem.Via = sprofile
+	}
+	return fitem, nil
+}
+
+func (s *MemoryStore) ItemScore(itemKey string, timelineKey string) int64 {
+	score, err := s.tdb.zscore(timelineKey, itemKey)
+	if err != nil {
+		return 0
+	}
+	return int64(score)
+}
+
+// Gets a raw item
+func (s *MemoryStore) Item(id ItemIdType) (*Item, error) {
+	return s.ItemByKey(ItemKey(id))
+}
+
+// Gets a raw item
+func (s *MemoryStore) ItemByKey(itemKey string) (*Item, error) {
+	val, err := s.idb.get(itemKey)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &Item{}
+	_ = json.Unmarshal([]byte(val), item)
+
+	return item, nil
+}
+
+func (s *MemoryStore) AddItem(pid PidType, ets time.Time, text string, link string, image string, itemid ItemIdType, media string, duration int) (ItemIdType, error) {
+	if itemid == "" {
+		itemid = defaultItemId(pid, ets, text, link)
+	}
+
+	if exists, _ := s.ItemExists(itemid); exists {
+		applog.Debugf("Attempted to add item %s but it already exists", itemid)
+		// promote it instead
+		return itemid, s.Promote(pid, itemid)
+	}
+
+	item := &Item{
+		Id:       itemid,
+		Text:     text,
+		Link:     link,
+		Pid:      pid,
+		Added:    time.Now().UnixNano(),
+		Event:    FakeEventPrecision(ets),
+		Image:    image,
+		Media:    media,
+		Duration: duration,
+	}
+
+	itemKey, err := s.SaveItem(item, 0)
+	if err != nil {
+		return "", err
+	}
+
+	scheduledTime := item.DefaultScheduledTime()
+
+	s.tdb.zadd(maybeKey(pid, ORDERING_TS), float64(scheduledTime), itemKey)
+
+	s.AddItemToFollowerTimelines(pid, scheduledTime, item)
+
+	if item.Link != "" && item.Image == "" {
+		s.pdb.sadd(ITEMS_NEEDING_IMAGES, string(itemid))
+	}
+
+	return itemid, nil
+}
+
+// lifetime is in seconds, 0 means permanent
+func (s *MemoryStore) SaveItem(item *Item, lifetime int) (string, error) {
+	item.Sanitize()
+	s.UpdateItem(item)
+
+	itemKey := ItemKey(item.Id)
+	s.idb.sadd(authoredKey(item.Pid), string(item.Id))
+
+	if lifetime > 0 {
+		s.idb.expire(itemKey, time.Duration(lifetime)*time.Second)
+	}
+
+	return itemKey, nil
+}
+
+func (s *MemoryStore) UpdateItem(item *Item) error {
+	if strings.Contains(item.Image, "/") {
+		s.cacheItemImage(item)
+	}
+
+	json, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	s.idb.set(ItemKey(item.Id), string(json))
+	return nil
+}
+
+func (s *MemoryStore) EditItem(item *Item) error {
+	old, err := s.Item(item.Id)
+	if err != nil {
+		return err
+	}
+
+	// The author and creation time can't be edited
+	item.Pid = old.Pid
+	item.Added = old.Added
+
+	if err := s.UpdateItem(item); err != nil {
+		return err
+	}
+
+	if item.Event == old.Event {
+		return nil
+	}
+
+	itemKey := ItemKey(item.Id)
+	scheduledTime := item.DefaultScheduledTime()
+
+	for _, pid := range s.itemTimelinePids(old) {
+		if pid != item.Pid && !item.IsEvent() {
+			continue
+		}
+
+		s.rescheduleInTimeline(maybeKey(pid, ORDERING_TS), scheduledTime, itemKey)
+		for _, m := range s.pdb.zrange(followersKey(pid), 0, MaxInt) {
+			s.rescheduleInTimeline(possiblyKey(PidType(m.member), ORDERING_TS), scheduledTime, itemKey)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteItem(id ItemIdType) error {
+	item, err := s.Item(id)
+	if err != nil {
+		return err
+	}
+
+	itemKey := ItemKey(id)
+
+	for _, pid := range s.itemTimelinePids(item) {
+		s.tdb.zrem(maybeKey(pid, ORDERING_TS), itemKey)
+		s.RemoveItemFromFollowerTimelines(pid, itemKey)
+	}
+
+	s.tdb.del(promotersKey(itemKey))
+	s.pdb.srem(ITEMS_NEEDING_IMAGES, string(id))
+	s.idb.srem(authoredKey(item.Pid), string(id))
+	s.idb.del(itemKey)
+
+	return nil
+}
+
+func (s *MemoryStore) itemTimelinePids(item *Item) []PidType {
+	pids := []PidType{item.Pid}
+	for _, pid := range s.tdb.smembers(promotersKey(item.Key())) {
+		if PidType(pid) != item.Pid {
+			pids = append(pids, PidType(pid))
+		}
+	}
+	return pids
+}
+
+func (s *MemoryStore) RebuildPromotersIndex() (int, error) {
+	n := 0
+	suffix := maybeKey("", ORDERING_TS)
+
+	keys := s.tdb.keys(func(key string) bool {
+		return strings.HasSuffix(key, suffix)
+	})
+	for _, key := range keys {
+		pid := PidType(strings.TrimSuffix(key, suffix))
+		for _, m := range s.tdb.zrange(key, 0, -1) {
+			item, err := s.ItemByKey(m.member)
+			if err != nil || item.Pid == pid {
+				continue
+			}
+			s.tdb.sadd(promotersKey(m.member), string(pid))
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) rescheduleInTimeline(timelineKey string, ts int64, itemKey string) {
+	s.timelineMu.Lock()
+	defer s.timelineMu.Unlock()
+
+	if _, err := s.tdb.zscore(timelineKey, itemKey); err == nil {
+		s.tdb.zadd(timelineKey, float64(ts), itemKey)
+	}
+}
+
+func (s *MemoryStore) ItemExists(id ItemIdType) (bool, error) {
+	return s.idb.exists(ItemKey(id)), nil
+}
+
+func (s *MemoryStore) DeleteMaybeItems(pid PidType) error {
+	s.tdb.del(maybeKey(pid, ORDERING_TS))
+	return nil
+}
+
+func (s *MemoryStore) ResetAll() error {
+	s.pdb.flush()
+	s.tdb.flush()
+	s.idb.flush()
+	s.sdb.flush()
+	return nil
+}
+
+// Make pid follow followpid
+func (s *MemoryStore) Follow(pid PidType, followpid PidType) error {
+	if pid == followpid {
+		return fmt.Errorf("pid cannot follow itself")
+	}
+
+	score := followerScore(time.Now())
+
+	s.pdb.zadd(followingKey(pid), score, string(followpid))
+	s.pdb.zadd(followersKey(followpid), score, string(pid))
+
+	// Copy all of followpid's items into pid's timeline
+	for _, m := range s.tdb.zrangeByScore(maybeKey(followpid, ORDERING_TS), scoreRange{min: 0, max: math.Inf(1)}, 0, -1, false) {
+		s.AddItemToTimeline(pid, followpid, int64(m.score), m.member)
+	}
+	return nil
+}
+
+// Make pid stop following followpid
+func (s *MemoryStore) Unfollow(pid PidType, followpid PidType) error {
+	s.pdb.zrem(followingKey(pid), string(followpid))
+	s.pdb.zrem(followersKey(followpid), string(pid))
+
+	// Remove all of followpid's items from pid's timeline
+	for _, m := range s.tdb.zrangeByScore(maybeKey(followpid, ORDERING_TS), scoreRange{min: 0, max: math.Inf(1)}, 0, -1, false) {
+		s.RemoveItemFromTimeline(pid, followpid, m.member)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Promote(pid PidType, id ItemIdType) error {
+	itemKey := ItemKey(id)
+
+	// Ensure the item is persisted (in case it's a temporary search item)
+	s.idb.persist(itemKey)
+
+	item, err := s.Item(id)
+	if err != nil {
+		return err
+	}
+
+	scheduledTime := time.Now().UnixNano()
+	if item.IsEvent() {
+		scheduledTime = item.Event
+	}
+
+	s.tdb.zadd(maybeKey(pid, ORDERING_TS), float64(scheduledTime), itemKey)
+	if pid != item.Pid {
+		s.tdb.sadd(promotersKey(itemKey), string(pid))
+	}
+
+	s.AddItemToFollowerTimelines(pid, scheduledTime, item)
+
+	return nil
+}
+
+// Fan-out is applied synchronously so there is never anything to wait for
+func (s *MemoryStore) WaitForFanout(id ItemIdType, timeout time.Duration) error {
+	return nil
+}
+
+func (s *MemoryStore) Demote(pid PidType, id ItemIdType) error {
+	itemKey := ItemKey(id)
+
+	s.tdb.zrem(maybeKey(pid, ORDERING_TS), itemKey)
+	s.tdb.srem(promotersKey(itemKey), string(pid))
+
+	s.RemoveItemFromFollowerTimelines(pid, itemKey)
+
+	return nil
+}
+
+func (s *MemoryStore) Followers(pid PidType, count int, start int) ([]*FollowingProfile, error) {
+	profiles := make([]*FollowingProfile, 0)
+
+	for _, m := range s.pdb.zrange(followersKey(pid), start, start+count) {
+		fpid := PidType(m.member)
+		profile, err := s.Profile(fpid)
+		if err != nil {
+			applog.Errorf("Could not retrieve profile for %s: %s", fpid, err.Error())
+			continue
+		}
+		follows, _ := s.Follows(fpid, pid)
+		profiles = append(profiles, &FollowingProfile{Profile: *profile, Reciprocal: follows})
+	}
+
+	return profiles, nil
+}
+
+func (s *MemoryStore) Following(pid PidType, count int, start int) ([]*FollowingProfile, error) {
+	profiles := make([]*FollowingProfile, 0)
+
+	for _, m := range s.pdb.zrange(followingKey(pid), start, start+count) {
+		fpid := PidType(m.member)
+		profile, err := s.Profile(fpid)
+		if err != nil {
+			applog.Errorf("Could not retrieve profile for %s: %s", fpid, err.Error())
+			continue
+		}
+		follows, _ := s.Follows(pid, fpid)
+		profiles = append(profiles, &FollowingProfile{Profile: *profile, Reciprocal: follows})
+	}
+
+	return profiles, nil
+}
+
+// Returns whether follower follows pid
+func (s *MemoryStore) Follows(pid PidType, follower PidType) (bool, error) {
+	_, err := s.pdb.zscore(followersKey(pid), string(follower))
+	return err == nil, nil
+}
+
+func (s *MemoryStore) Feeds(pid PidType) ([]*Profile, error) {
+	feeds := make([]*Profile, 0)
+
+	for _, fid := range s.pdb.smembers(feedsKey(pid)) {
+		feed, err := s.Profile(PidType(fid))
+		if err != nil {
+			applog.Errorf("Could not retrieve profile for feed %s: %s", fid, err.Error())
+			continue
+		}
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, nil
+}
+
+func (s *MemoryStore) GrabItemsNeedingImages(max int) ([]*Item, error) {
+	items := make([]*Item, 0)
+
+	for i := 0; i < max; i++ {
+		itemid, err := s.pdb.spop(ITEMS_NEEDING_IMAGES)
+		if err != nil {
+			break
+		}
+
+		item, err := s.Item(ItemIdType(itemid))
+		if err == nil {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (s *MemoryStore) AddItemToFollowerTimelines(pid PidType, scheduledTime int64, item *Item) error {
+	for _, m := range s.pdb.zrange(followersKey(pid), 0, MaxInt) {
+		// Don't add circular references
+		if PidType(m.member) != item.Pid {
+			s.AddItemToTimeline(PidType(m.member), pid, scheduledTime, item.Key())
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) AddItemToTimeline(pid PidType, source PidType, ts int64, itemKey string) error {
+	timelineKey := possiblyKey(pid, ORDERING_TS)
+
+	s.timelineMu.Lock()
+	defer s.timelineMu.Unlock()
+
+	if _, err := s.tdb.zscore(timelineKey, itemKey); err == nil {
+		return nil
+	}
+
+	s.tdb.zadd(timelineKey, float64(ts), itemKey)
+
+	// Remember the source of the item
+	s.tdb.hset(sourcesKey(pid), itemKey, string(source))
+
+	return nil
+}
+
+func (s *MemoryStore) RemoveItemFromFollowerTimelines(pid PidType, itemKey string) error {
+	for _, m := range s.pdb.zrange(followersKey(pid), 0, MaxInt) {
+		s.RemoveItemFromTimeline(PidType(m.member), pid, itemKey)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) RemoveItemFromTimeline(pid PidType, source PidType, itemKey string) error {
+	s.removeFromTimeline(pid, source, itemKey)
+	return nil
+}
+
+func (s *MemoryStore) removeFromTimeline(pid PidType, source PidType, itemKey string) bool {
+	sourcesKey := sourcesKey(pid)
+
+	s.timelineMu.Lock()
+	defer s.timelineMu.Unlock()
+
+	// Only remove if source is same as the source recorded for this timeline
+	if recorded, err := s.tdb.hget(sourcesKey, itemKey); err != nil || PidType(recorded) != source {
+		return false
+	}
+
+	s.tdb.zrem(possiblyKey(pid, ORDERING_TS), itemKey)
+	s.tdb.hdel(sourcesKey, itemKey)
+
+	return true
+}
@@ -0,0 +1,110 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrOauthStateNotFound = errors.New("datastore: oauth state not found, expired or already used")
+
+// OauthState is the information kept between redirecting a user to an OAuth
+// provider and handling the provider's callback
+type OauthState struct {
+	Provider     string `json:"provider"`
+	RedirectUri  string `json:"redirecturi"`
+	PkceVerifier string `json:"pkceverifier,omitempty"`
+	Created      int64  `json:"created"`
+}
+
+// Stores a copy of the state for an OAuth flow under key, recording when it
+// was created. The state expires after the configured lifetime.
+func (s *RedisStore) SetOauthState(key string, state *OauthState) error {
+	stored := *state
+	stored.Created = time.Now().UnixNano()
+
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+
+	return s.SetOauthSessionData(key, string(data))
+}
+
+// Gets the state stored under key and deletes it so that it can't be used
+// again
+func (s *RedisStore) TakeOauthState(key string) (*OauthState, error) {
+	rs := takeScript.run(s.sdb, []string{oauthSessionKey(key)})
+	if !rs.IsOK() {
+		if isKeyNotFound(rs.Error()) {
+			return nil, ErrOauthStateNotFound
+		}
+		return nil, rs.Error()
+	}
+
+	return decodeOauthState(rs.ValueAsString())
+}
+
+func decodeOauthState(data string) (*OauthState, error) {
+	if data == "" {
+		return nil, ErrOauthStateNotFound
+	}
+
+	state := &OauthState{}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (s *RedisStore) SetOauthSessionData(key string, data string) error {
+	rs := s.sdb.Command("SET", oauthSessionKey(key), data, "EX", s.config.OAuth.StateLifetime)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// Deprecated: the data can be read more than once. Use TakeOauthState.
+func (s *RedisStore) GetOauthSessionData(key string) (string, error) {
+	rs := s.sdb.Command("GET", oauthSessionKey(key))
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	return rs.ValueAsString(), nil
+
+}
+
+func (s *MemoryStore) SetOauthState(key string, state *OauthState) error {
+	stored := *state
+	stored.Created = time.Now().UnixNano()
+
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+
+	return s.SetOauthSessionData(key, string(data))
+}
+
+func (s *MemoryStore) TakeOauthState(key string) (*OauthState, error) {
+	data, err := s.sdb.getdel(oauthSessionKey(key))
+	if err != nil {
+		return nil, ErrOauthStateNotFound
+	}
+
+	return decodeOauthState(data)
+}
+
+func (s *MemoryStore) SetOauthSessionData(key string, data string) error {
+	s.sdb.set(oauthSessionKey(key), data)
+	s.sdb.expire(oauthSessionKey(key), time.Duration(s.config.OAuth.StateLifetime)*time.Second)
+	return nil
+}
+
+func (s *MemoryStore) GetOauthSessionData(key string) (string, error) {
+	return s.sdb.get(oauthSessionKey(key))
+}
@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func setTestOauthLifetime(s Store, lifetime int) {
+	switch s := s.(type) {
+	case *RedisStore:
+		s.config.OAuth.StateLifetime = lifetime
+	case *MemoryStore:
+		s.config.OAuth.StateLifetime = lifetime
+	}
+}
+
+func TestTakeOauthState(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		state := &OauthState{Provider: "twitter", RedirectUri: "/home", PkceVerifier: "verifier"}
+		if err := s.SetOauthState("key", state); err != nil {
+			t.Fatalf("SetOauthState: %s", err)
+		}
+		if state.Created != 0 {
+			t.Errorf("caller's state was changed, created %d", state.Created)
+		}
+
+		taken, err := s.TakeOauthState("key")
+		if err != nil {
+			t.Fatalf("TakeOauthState: %s", err)
+		}
+		if taken.Provider != state.Provider || taken.RedirectUri != state.RedirectUri || taken.PkceVerifier != state.PkceVerifier || taken.Created == 0 {
+			t.Errorf("taken state = %+v, want %+v with its creation time", taken, state)
+		}
+
+		// Each state can only be used once
+		if _, err := s.TakeOauthState("key"); err != ErrOauthStateNotFound {
+			t.Errorf("second TakeOauthState = %v, want %v", err, ErrOauthStateNotFound)
+		}
+		if _, err := s.TakeOauthState("unknown"); err != ErrOauthStateNotFound {
+			t.Errorf("TakeOauthState(unknown) = %v, want %v", err, ErrOauthStateNotFound)
+		}
+	})
+}
+
+func TestOauthStateExpiry(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		setTestOauthLifetime(s, 1)
+
+		if err := s.SetOauthState("key", &OauthState{Provider: "twitter"}); err != nil {
+			t.Fatalf("SetOauthState: %s", err)
+		}
+
+		time.Sleep(1500 * time.Millisecond)
+
+		if _, err := s.TakeOauthState("key"); err != ErrOauthStateNotFound {
+			t.Errorf("TakeOauthState after expiry = %v, want %v", err, ErrOauthStateNotFound)
+		}
+	})
+}
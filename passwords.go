@@ -0,0 +1,231 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"code.google.com/p/go.crypto/bcrypt"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Password hashes are stored as "<scheme>:<hash>" so that the algorithm can
+// be changed later. Hashes written before schemes were recorded are plain
+// bcrypt hashes. A hash is replaced when its owner next logs in if it uses an
+// old scheme or a cost other than Config.Passwords.Cost.
+
+var (
+	ErrPasswordTooShort      = errors.New("datastore: password is too short")
+	ErrPasswordDenied        = errors.New("datastore: password is too easily guessed")
+	ErrUnknownPasswordScheme = errors.New("datastore: unknown password hash scheme")
+	ErrIncorrectPassword     = errors.New("datastore: incorrect password")
+)
+
+// passwordScheme is a way of hashing passwords
+type passwordScheme interface {
+	hash(password []byte, cost int) ([]byte, error)
+	compare(hash []byte, password []byte) error
+
+	// Reports whether hash should be replaced by one made with cost
+	outdated(hash []byte, cost int) bool
+}
+
+type bcryptScheme struct{}
+
+func (bcryptScheme) hash(password []byte, cost int) ([]byte, error) {
+	return bcrypt.GenerateFromPassword(password, cost)
+}
+
+func (bcryptScheme) compare(hash []byte, password []byte) error {
+	err := bcrypt.CompareHashAndPassword(hash, password)
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return ErrIncorrectPassword
+	}
+	return err
+}
+
+func (bcryptScheme) outdated(hash []byte, cost int) bool {
+	c, err := bcrypt.Cost(hash)
+	return err != nil || c != cost
+}
+
+const currentPasswordScheme = "bcrypt"
+
+var passwordSchemes = map[string]passwordScheme{
+	"bcrypt": bcryptScheme{},
+}
+
+func (c PasswordConfig) cost() int {
+	if c.Cost < bcrypt.MinCost {
+		return bcrypt.DefaultCost
+	}
+	return c.Cost
+}
+
+// Hashes password with the current scheme
+func hashPassword(password string, config PasswordConfig) ([]byte, error) {
+	hash, err := passwordSchemes[currentPasswordScheme].hash([]byte(password), config.cost())
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(currentPasswordScheme+":"), hash...), nil
+}
+
+// Checks password against a stored hash, reporting whether the hash should be
+// replaced by one made with the current scheme and cost.
+func checkPassword(stored []byte, password string, config PasswordConfig) (bool, error) {
+	name, hash := currentPasswordScheme, stored
+	legacy := true
+	if i := strings.Index(string(stored), ":"); i > 0 && !strings.HasPrefix(string(stored), "$") {
+		name, hash = string(stored[:i]), stored[i+1:]
+		legacy = false
+	}
+
+	scheme, exists := passwordSchemes[name]
+	if !exists {
+		return false, ErrUnknownPasswordScheme
+	}
+
+	if err := scheme.compare(hash, []byte(password)); err != nil {
+		return false, err
+	}
+
+	return legacy || name != currentPasswordScheme || scheme.outdated(hash, config.cost()), nil
+}
+
+// Check reports whether password is acceptable for pid under the policy,
+// returning ErrPasswordTooShort or ErrPasswordDenied if not.
+func (c PasswordConfig) Check(pid PidType, password string) error {
+	if utf8.RuneCountInString(password) < c.MinLength {
+		return ErrPasswordTooShort
+	}
+
+	if strings.EqualFold(password, string(pid)) {
+		return ErrPasswordDenied
+	}
+
+	for _, denied := range c.Deny {
+		if strings.EqualFold(password, denied) {
+			return ErrPasswordDenied
+		}
+	}
+
+	return nil
+}
+
+// Replaces a password hash, unless it has been changed since it was read.
+// KEYS: profile
+// ARGV: old hash, new hash
+var replacePasswordHashScript = newLuaScript(`
+if redis.call('HGET', KEYS[1], 'pwdhash') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'pwdhash', ARGV[2])
+return 1
+`)
+
+// Checks the password for pid. The stored hash is upgraded to the current
+// scheme and cost when the password is correct. Failures are throttled as
+// described for VerifyPasswordFrom.
+func (s *RedisStore) VerifyPassword(pid PidType, password string) (bool, error) {
+	return s.VerifyPasswordFrom(pid, password, "")
+}
+
+func (s *RedisStore) checkPasswordHash(pid PidType, password string) (bool, error) {
+	rs := s.pdb.Command("HGET", profileKey(pid), "pwdhash")
+	if !rs.IsOK() {
+		return false, rs.Error()
+	}
+
+	pwdhash := rs.ValueAsString()
+
+	rehash, err := checkPassword([]byte(pwdhash), password, s.config.Passwords)
+	if err != nil {
+		return false, err
+	}
+
+	if rehash {
+		if newhash, err := hashPassword(password, s.config.Passwords); err == nil {
+			rs = replacePasswordHashScript.run(s.pdb, []string{string(profileKey(pid))}, pwdhash, newhash)
+			if !rs.IsOK() {
+				applog.Errorf("Could not upgrade password hash for %s: %s", pid, rs.Error().Error())
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// Changes the password for pid after checking the current password and
+// that the new one meets Config.Passwords.
+func (s *RedisStore) ChangePassword(pid PidType, oldPassword string, newPassword string) error {
+	if _, err := s.VerifyPassword(pid, oldPassword); err != nil {
+		return err
+	}
+
+	return s.setPassword(pid, newPassword)
+}
+
+func (s *RedisStore) setPassword(pid PidType, password string) error {
+	if err := s.config.Passwords.Check(pid, password); err != nil {
+		return err
+	}
+
+	pwdhash, err := hashPassword(password, s.config.Passwords)
+	if err != nil {
+		return err
+	}
+
+	rs := s.pdb.Command("HSET", profileKey(pid), "pwdhash", pwdhash)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) VerifyPassword(pid PidType, password string) (bool, error) {
+	return s.VerifyPasswordFrom(pid, password, "")
+}
+
+func (s *MemoryStore) checkPasswordHash(pid PidType, password string) (bool, error) {
+	pwdhash, err := s.pdb.hget(string(profileKey(pid)), "pwdhash")
+	if err != nil {
+		return false, err
+	}
+
+	rehash, err := checkPassword([]byte(pwdhash), password, s.config.Passwords)
+	if err != nil {
+		return false, err
+	}
+
+	if rehash {
+		if newhash, err := hashPassword(password, s.config.Passwords); err == nil {
+			s.pdb.hsetIfEqual(string(profileKey(pid)), "pwdhash", pwdhash, string(newhash))
+		}
+	}
+
+	return true, nil
+}
+
+func (s *MemoryStore) ChangePassword(pid PidType, oldPassword string, newPassword string) error {
+	if _, err := s.VerifyPassword(pid, oldPassword); err != nil {
+		return err
+	}
+
+	return s.setPassword(pid, newPassword)
+}
+
+func (s *MemoryStore) setPassword(pid PidType, password string) error {
+	if err := s.config.Passwords.Check(pid, password); err != nil {
+		return err
+	}
+
+	pwdhash, err := hashPassword(password, s.config.Passwords)
+	if err != nil {
+		return err
+	}
+
+	s.pdb.hset(string(profileKey(pid)), "pwdhash", string(pwdhash))
+	return nil
+}
@@ -2,24 +2,25 @@ package datastore
 
 type Profile struct {
 	Pid                  PidType `json:"pid"`
-	Name                 string  `json:"name,omitempty"`
-	PasswordHash         []byte  `json:"-"`
-	Bio                  string  `json:"bio,omitempty"`
-	Email                string  `json:"email,omitempty"`
-	Joined               int64   `json:"joined,omitempty"`
-	Location             string  `json:"location,omitempty"`
-	Url                  string  `json:"url,omitempty"`
-	ProfileImageUrl      string  `json:"profileimageurl,omitempty"`
-	ProfileImageUrlHttps string  `json:"profileimageurlhttps,omitempty"`
+	Name                 string  `json:"name,omitempty" redis:"name,writable"`
+	PasswordHash         []byte  `json:"-" redis:"pwdhash,writeonly"`
+	Bio                  string  `json:"bio,omitempty" redis:"bio,writable"`
+	Email                string  `json:"email,omitempty" redis:"email,writable"`
+	EmailVerified        int64   `json:"emailverified,omitempty" redis:"emailverified"`
+	Joined               int64   `json:"joined,omitempty" redis:"joined"`
+	Location             string  `json:"location,omitempty" redis:"location,writable"`
+	Url                  string  `json:"url,omitempty" redis:"url,writable"`
+	ProfileImageUrl      string  `json:"profileimageurl,omitempty" redis:"profileimageurl,writable"`
+	ProfileImageUrlHttps string  `json:"profileimageurlhttps,omitempty" redis:"profileimageurlhttps,writable"`
 	PossiblyCount        int     `json:"pcount"`
 	MaybeCount           int     `json:"mcount"`
 	FollowerCount        int     `json:"followercount"`
 	FollowingCount       int     `json:"followingcount"`
 	FeedCount            int     `json:"feedcount"`
-	FeedType             string  `json:"feedtype"`
-	FeedUrl              string  `json:"feedurl,omitempty"`
-	ParentPid            PidType `json:"parentpid,omitempty"`
-	ItemType             string  `json:"itemtype,omitempty"`
+	FeedType             string  `json:"feedtype" redis:"feedtype,writable"`
+	FeedUrl              string  `json:"feedurl,omitempty" redis:"feedurl,writable"`
+	ParentPid            PidType `json:"parentpid,omitempty" redis:"parentpid,writable"`
+	ItemType             string  `json:"itemtype,omitempty" redis:"itemtype,writable"`
 }
 
 type ScoredProfile struct {
@@ -34,6 +35,6 @@ type FollowingProfile struct {
 
 type BriefProfile struct {
 	Pid                  PidType `json:"pid"`
-	Name                 string  `json:"name,omitempty"`
-	ProfileImageUrlHttps string  `json:"profileimageurlhttps,omitempty"`
+	Name                 string  `json:"name,omitempty" redis:"name"`
+	ProfileImageUrlHttps string  `json:"profileimageurlhttps,omitempty" redis:"profileimageurlhttps"`
 }
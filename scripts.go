@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"code.google.com/p/tcgl/redis"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// luaScript is a script run on the redis server so that a sequence of
+// commands is applied atomically
+type luaScript struct {
+	src string
+	sha string
+}
+
+func newLuaScript(src string) *luaScript {
+	hasher := sha1.New()
+	io.WriteString(hasher, src)
+	return &luaScript{src: src, sha: fmt.Sprintf("%x", hasher.Sum(nil))}
+}
+
+// Runs the script by its digest, falling back to sending the source if the
+// server hasn't seen it yet
+func (sc *luaScript) run(db *redis.Database, keys []string, args ...interface{}) *redis.ResultSet {
+	params := make([]interface{}, 0, 2+len(keys)+len(args))
+	params = append(params, sc.sha, len(keys))
+	for _, key := range keys {
+		params = append(params, key)
+	}
+	params = append(params, args...)
+
+	rs := db.Command("EVALSHA", params...)
+	if !rs.IsOK() && strings.Contains(rs.Error().Error(), "NOSCRIPT") {
+		params[0] = sc.src
+		rs = db.Command("EVAL", params...)
+	}
+	return rs
+}
+
+// Adds an item to a timeline and records its source, unless the item is
+// already in the timeline.
+// KEYS: timeline, sources
+// ARGV: score, item key, source pid
+var addToTimelineScript = newLuaScript(`
+if redis.call('ZSCORE', KEYS[1], ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+redis.call('HSET', KEYS[2], ARGV[2], ARGV[3])
+return 1
+`)
+
+// Removes an item from a timeline along with its source, but only if it was
+// added from the given source.
+// KEYS: timeline, sources
+// ARGV: item key, source pid
+var removeFromTimelineScript = newLuaScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[2] then
+	return 0
+end
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1
+`)
+
+// Moves an item to a new score, but only if it is already in the timeline.
+// KEYS: timeline
+// ARGV: score, item key
+var rescheduleInTimelineScript = newLuaScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// Gets a value and deletes it so it can only be read once.
+// KEYS: key
+var takeScript = newLuaScript(`
+local val = redis.call('GET', KEYS[1])
+if val then
+	redis.call('DEL', KEYS[1])
+end
+return val
+`)
@@ -0,0 +1,120 @@
+package datastore
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// Moves an item in pid's possibly timeline using the store's own reschedule
+func rescheduleTestItem(s Store, pid PidType, ts int64, itemKey string) error {
+	switch s := s.(type) {
+	case *RedisStore:
+		return s.rescheduleInTimeline(possiblyKey(pid, ORDERING_TS), ts, itemKey)
+	case *MemoryStore:
+		s.rescheduleInTimeline(possiblyKey(pid, ORDERING_TS), ts, itemKey)
+		return nil
+	}
+	panic("unknown store")
+}
+
+// Reads the source recorded for an item in pid's possibly timeline
+func testItemSource(t *testing.T, s Store, pid PidType, itemKey string) (PidType, bool) {
+	switch s := s.(type) {
+	case *RedisStore:
+		rs := s.tdb.Command("HGET", sourcesKey(pid), itemKey)
+		if !rs.IsOK() {
+			if isKeyNotFound(rs.Error()) {
+				return "", false
+			}
+			t.Fatalf("HGET: %s", rs.Error())
+		}
+		return PidType(rs.ValueAsString()), true
+	case *MemoryStore:
+		source, err := s.tdb.hget(sourcesKey(pid), itemKey)
+		return PidType(source), err == nil
+	}
+	panic("unknown store")
+}
+
+// Runs f concurrently n times and waits for them all to finish
+func concurrently(t *testing.T, n int, f func(i int) error) {
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := f(i); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestTimelineScriptsConcurrent(t *testing.T) {
+	const sources = 8
+
+	forEachStore(t, func(t *testing.T, s Store) {
+		timelineKey := possiblyKey("reader", ORDERING_TS)
+		source := func(i int) PidType { return PidType(fmt.Sprintf("source%d", i)) }
+
+		for round := 0; round < 20; round++ {
+			itemKey := fmt.Sprintf("item:%d", round)
+
+			// Only the first source to add the item is recorded, along with
+			// its score
+			concurrently(t, sources, func(i int) error {
+				return s.AddItemToTimeline("reader", source(i), int64(1000+i), itemKey)
+			})
+
+			winner, ok := testItemSource(t, s, "reader", itemKey)
+			if !ok {
+				t.Fatalf("no source recorded for %s", itemKey)
+			}
+			ts := s.ItemScore(itemKey, timelineKey)
+			if ts < 1000 || ts >= 1000+sources || source(int(ts-1000)) != winner {
+				t.Fatalf("%s has score %d but source %s", itemKey, ts, winner)
+			}
+
+			// Other sources can't remove it while it is rescheduled
+			concurrently(t, sources*2, func(i int) error {
+				if i%2 == 0 {
+					return rescheduleTestItem(s, "reader", int64(2000+i), itemKey)
+				}
+				if source(i/2) == winner {
+					return nil
+				}
+				return s.RemoveItemFromTimeline("reader", source(i/2), itemKey)
+			})
+
+			if recorded, ok := testItemSource(t, s, "reader", itemKey); !ok || recorded != winner {
+				t.Fatalf("source of %s is %s, want %s", itemKey, recorded, winner)
+			}
+			if ts := s.ItemScore(itemKey, timelineKey); ts < 2000 {
+				t.Fatalf("%s was not rescheduled, score %d", itemKey, ts)
+			}
+
+			// Rescheduling never adds back an item removed by its source
+			concurrently(t, sources*2, func(i int) error {
+				if i == sources {
+					return s.RemoveItemFromTimeline("reader", winner, itemKey)
+				}
+				return rescheduleTestItem(s, "reader", int64(3000+i), itemKey)
+			})
+
+			if ts := s.ItemScore(itemKey, timelineKey); ts != 0 {
+				t.Fatalf("%s still in the timeline with score %d", itemKey, ts)
+			}
+			if recorded, ok := testItemSource(t, s, "reader", itemKey); ok {
+				t.Fatalf("source %s still recorded for %s", recorded, itemKey)
+			}
+		}
+	})
+}
@@ -0,0 +1,473 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"code.google.com/p/go.text/unicode/norm"
+	"code.google.com/p/tcgl/redis"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Profiles are found through an index in the profile database. Every prefix
+// of each word in a profile's pid, name, location and bio has a sorted set of
+// the pids it appears in, scored by where it appears. Whole words score twice
+// as much as prefixes, so exact matches rank first. A search intersects the
+// sets for each word of the query. The keys a profile appears under are kept
+// in a set so they can be removed when the profile changes.
+//
+// Words are lower cased and decomposed with their accents removed, so "Zoë"
+// is found by "zoe".
+
+const (
+	SEARCHABLE_PROFILES = "searchableprofiles"
+
+	searchMinPrefix     = 2
+	searchMaxPrefix     = 20
+	searchQueryLifetime = 60 // seconds an intersection is kept for
+
+	// Most profiles returned by FindProfilesBySubstring
+	substringSearchLimit = 100
+)
+
+// Fields that are searched and the weight of a match in each
+var searchFields = []struct {
+	name   string
+	weight float64
+}{
+	{"pid", 8},
+	{"name", 4},
+	{"location", 2},
+	{"bio", 1},
+}
+
+// Index keys end in a suffix of their own so they can't be mistaken for
+// profile keys, as "searchterm:info" would be
+func searchTermKey(prefix string) string {
+	return fmt.Sprintf("search:%s:term", prefix)
+}
+
+func searchDocKey(pid PidType) string {
+	return fmt.Sprintf("search:%s:doc", pid)
+}
+
+func searchQueryKey(keys []string) string {
+	return fmt.Sprintf("searchquery:%s", strings.Join(keys, " "))
+}
+
+// Splits text into lower case words without accents
+func searchTokens(text string) []string {
+	decomposed := norm.NFKD.String(strings.ToLower(text))
+
+	folded := make([]rune, 0, len(decomposed))
+	for _, r := range decomposed {
+		if !unicode.Is(unicode.Mn, r) {
+			folded = append(folded, r)
+		}
+	}
+
+	return strings.FieldsFunc(string(folded), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// The term keys a profile is indexed under with their scores
+func searchEntries(p *Profile) map[string]float64 {
+	texts := map[string]string{
+		"pid":      string(p.Pid),
+		"name":     p.Name,
+		"location": p.Location,
+		"bio":      p.Bio,
+	}
+
+	entries := make(map[string]float64)
+	for _, f := range searchFields {
+		// A prefix only counts once in each field
+		field := make(map[string]float64)
+		for _, token := range searchTokens(texts[f.name]) {
+			runes := []rune(token)
+			for n := searchMinPrefix; n <= len(runes) && n <= searchMaxPrefix; n++ {
+				weight := f.weight
+				if n == len(runes) {
+					weight *= 2
+				}
+				key := searchTermKey(string(runes[:n]))
+				if weight > field[key] {
+					field[key] = weight
+				}
+			}
+		}
+
+		for key, weight := range field {
+			entries[key] += weight
+		}
+	}
+
+	return entries
+}
+
+// The term keys to intersect for a query, without duplicates
+func searchQueryKeys(query string) []string {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, token := range searchTokens(query) {
+		runes := []rune(token)
+		if len(runes) < searchMinPrefix {
+			continue
+		}
+		if len(runes) > searchMaxPrefix {
+			runes = runes[:searchMaxPrefix]
+		}
+
+		key := searchTermKey(string(runes))
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Reports whether an update changes any searched field
+func indexedChange(values map[string]string) bool {
+	for _, f := range searchFields {
+		if _, exists := values[f.name]; exists {
+			return true
+		}
+	}
+	return false
+}
+
+func isSearchAll(query string) bool {
+	return strings.TrimSpace(query) == "*"
+}
+
+// Adds the profile to the search index, replacing any previous entries
+func (s *RedisStore) indexProfile(pid PidType) error {
+	rs := s.pdb.Command("HGETALL", profileKey(pid))
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	p := profileFromHash(pid, valuesToHash(rs.ValuesAsStrings()))
+	entries := searchEntries(p)
+
+	rs = s.pdb.Command("SMEMBERS", searchDocKey(pid))
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	old := rs.ValuesAsStrings()
+
+	rs = s.pdb.MultiCommand(func(mc *redis.MultiCommand) {
+		for _, key := range old {
+			if _, kept := entries[key]; !kept {
+				mc.Command("ZREM", key, pid)
+			}
+		}
+		mc.Command("DEL", searchDocKey(pid))
+		for key, score := range entries {
+			mc.Command("ZADD", key, score, pid)
+			mc.Command("SADD", searchDocKey(pid), key)
+		}
+		mc.Command("ZADD", SEARCHABLE_PROFILES, p.Joined, pid)
+	})
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+func (s *RedisStore) unindexProfile(pid PidType) error {
+	rs := s.pdb.Command("SMEMBERS", searchDocKey(pid))
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	for _, key := range rs.ValuesAsStrings() {
+		rs := s.pdb.Command("ZREM", key, pid)
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+	}
+
+	rs = s.pdb.Command("DEL", searchDocKey(pid))
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	rs = s.pdb.Command("ZREM", SEARCHABLE_PROFILES, pid)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// Finds the pids matching a query, best first. A count of zero returns every
+// match from start.
+func (s *RedisStore) searchPids(query string, start int, count int) ([]PidType, error) {
+	pids := make([]PidType, 0)
+
+	key := SEARCHABLE_PROFILES
+	if !isSearchAll(query) {
+		keys := searchQueryKeys(query)
+		switch len(keys) {
+		case 0:
+			return pids, nil
+		case 1:
+			key = keys[0]
+		default:
+			key = searchQueryKey(keys)
+			args := []interface{}{key, len(keys)}
+			for _, k := range keys {
+				args = append(args, k)
+			}
+			rs := s.pdb.Command("ZINTERSTORE", args...)
+			if !rs.IsOK() {
+				return pids, rs.Error()
+			}
+			rs = s.pdb.Command("EXPIRE", key, searchQueryLifetime)
+			if !rs.IsOK() {
+				return pids, rs.Error()
+			}
+		}
+	}
+
+	stop := start + count - 1
+	if count <= 0 {
+		stop = -1
+	}
+
+	rs := s.pdb.Command("ZREVRANGE", key, start, stop)
+	if !rs.IsOK() {
+		return pids, rs.Error()
+	}
+
+	for _, pid := range rs.ValuesAsStrings() {
+		pids = append(pids, PidType(pid))
+	}
+
+	return pids, nil
+}
+
+// SearchProfiles finds profiles whose pid, name, location or bio contain
+// words starting with every word of query, best matches first. A query of
+// "*" returns every profile, newest first. Results are paged by start and
+// count; a count of zero returns every match from start.
+func (s *RedisStore) SearchProfiles(query string, start int, count int) ([]*Profile, error) {
+	profiles := make([]*Profile, 0)
+
+	pids, err := s.searchPids(query, start, count)
+	if err != nil {
+		return profiles, err
+	}
+
+	for _, pid := range pids {
+		profile, err := s.Profile(pid)
+		if err != nil {
+			return profiles, err
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+// AutocompleteProfiles finds up to count profiles matching a partly typed
+// query as SearchProfiles does, returning brief profiles
+func (s *RedisStore) AutocompleteProfiles(query string, count int) ([]*BriefProfile, error) {
+	profiles := make([]*BriefProfile, 0)
+
+	pids, err := s.searchPids(query, 0, count)
+	if err != nil {
+		return profiles, err
+	}
+
+	brief, err := s.briefProfiles(pids)
+	if err != nil {
+		return profiles, err
+	}
+
+	for _, pid := range pids {
+		profiles = append(profiles, brief[pid])
+	}
+
+	return profiles, nil
+}
+
+// FindProfilesBySubstring returns up to substringSearchLimit profiles found
+// by SearchProfiles. It no longer matches substrings within pids, only words
+// of the pid, name, location or bio starting with the words of srch.
+//
+// Deprecated: use SearchProfiles
+func (s *RedisStore) FindProfilesBySubstring(srch string) ([]*Profile, error) {
+	return s.SearchProfiles(srch, 0, substringSearchLimit)
+}
+
+// Indexes every profile for searching, returning the number indexed. Only
+// needed for profiles added before the index was maintained.
+func (s *RedisStore) RebuildSearchIndex() (int, error) {
+	n := 0
+
+	err := scanProfiles(s.pdb, func(pids []PidType) error {
+		for _, pid := range pids {
+			if err := s.indexProfile(pid); err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+
+	return n, err
+}
+
+// Builds the search index when the store is first opened after it was added
+func (s *RedisStore) ensureSearchIndex() error {
+	rs := s.pdb.Command("EXISTS", SEARCHABLE_PROFILES)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	if exists, _ := rs.ValueAsBool(); exists {
+		return nil
+	}
+
+	n, err := s.RebuildSearchIndex()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		applog.Infof("Indexed %d profiles for searching", n)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) indexProfile(pid PidType) error {
+	p := profileFromHash(pid, s.pdb.hgetall(string(profileKey(pid))))
+	entries := searchEntries(p)
+
+	for _, key := range s.pdb.smembers(searchDocKey(pid)) {
+		if _, kept := entries[key]; !kept {
+			s.pdb.zrem(key, string(pid))
+		}
+	}
+	s.pdb.del(searchDocKey(pid))
+
+	for key, score := range entries {
+		s.pdb.zadd(key, score, string(pid))
+		s.pdb.sadd(searchDocKey(pid), key)
+	}
+	s.pdb.zadd(SEARCHABLE_PROFILES, float64(p.Joined), string(pid))
+
+	return nil
+}
+
+func (s *MemoryStore) unindexProfile(pid PidType) error {
+	for _, key := range s.pdb.smembers(searchDocKey(pid)) {
+		s.pdb.zrem(key, string(pid))
+	}
+	s.pdb.del(searchDocKey(pid))
+	s.pdb.zrem(SEARCHABLE_PROFILES, string(pid))
+	return nil
+}
+
+func (s *MemoryStore) searchPids(query string, start int, count int) ([]PidType, error) {
+	pids := make([]PidType, 0)
+
+	var matches []scoredMember
+	if isSearchAll(query) {
+		matches = s.pdb.zrange(SEARCHABLE_PROFILES, 0, -1)
+	} else {
+		keys := searchQueryKeys(query)
+		if len(keys) == 0 {
+			return pids, nil
+		}
+
+		scores := make(map[string]float64)
+		for _, m := range s.pdb.zrange(keys[0], 0, -1) {
+			scores[m.member] = m.score
+		}
+		for _, key := range keys[1:] {
+			next := make(map[string]float64)
+			for _, m := range s.pdb.zrange(key, 0, -1) {
+				if score, exists := scores[m.member]; exists {
+					next[m.member] = score + m.score
+				}
+			}
+			scores = next
+		}
+
+		matches = make([]scoredMember, 0, len(scores))
+		for member, score := range scores {
+			matches = append(matches, scoredMember{member: member, score: score})
+		}
+		sort.Sort(byScore(matches))
+	}
+
+	for i := len(matches) - 1 - start; i >= 0; i-- {
+		if count > 0 && len(pids) == count {
+			break
+		}
+		pids = append(pids, PidType(matches[i].member))
+	}
+
+	return pids, nil
+}
+
+func (s *MemoryStore) SearchProfiles(query string, start int, count int) ([]*Profile, error) {
+	profiles := make([]*Profile, 0)
+
+	pids, err := s.searchPids(query, start, count)
+	if err != nil {
+		return profiles, err
+	}
+
+	for _, pid := range pids {
+		profile, err := s.Profile(pid)
+		if err != nil {
+			return profiles, err
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+func (s *MemoryStore) AutocompleteProfiles(query string, count int) ([]*BriefProfile, error) {
+	profiles := make([]*BriefProfile, 0)
+
+	pids, err := s.searchPids(query, 0, count)
+	if err != nil {
+		return profiles, err
+	}
+
+	for _, pid := range pids {
+		profile, err := s.BriefProfile(pid)
+		if err != nil {
+			return profiles, err
+		}
+		profiles = append(profiles, profile)
+	}
+
+	return profiles, nil
+}
+
+// Deprecated: use SearchProfiles
+func (s *MemoryStore) FindProfilesBySubstring(srch string) ([]*Profile, error) {
+	return s.SearchProfiles(srch, 0, substringSearchLimit)
+}
+
+func (s *MemoryStore) RebuildSearchIndex() (int, error) {
+	pids := s.profilePids()
+
+	for _, pid := range pids {
+		s.indexProfile(pid)
+	}
+
+	return len(pids), nil
+}
@@ -0,0 +1,83 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFindProfilesBySubstring(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		for i := 0; i < substringSearchLimit+5; i++ {
+			addTestProfile(t, s, PidType(fmt.Sprintf("user%03d", i)))
+		}
+
+		if profiles, err := s.FindProfilesBySubstring("*"); err != nil || len(profiles) != substringSearchLimit {
+			t.Errorf("FindProfilesBySubstring = %d profiles, %v, want %d", len(profiles), err, substringSearchLimit)
+		}
+		if profiles, err := s.FindProfilesBySubstring("user007"); err != nil || len(profiles) != 1 || profiles[0].Pid != "user007" {
+			t.Errorf("FindProfilesBySubstring(user007) = %v, %v", profiles, err)
+		}
+	})
+}
+
+func TestSearchIndexOnStartup(t *testing.T) {
+	s := newTestRedisStore(t)
+
+	pids := make([]PidType, 0)
+	for i := 0; i < scanBatchSize+10; i++ {
+		pid := PidType(fmt.Sprintf("user%04d", i))
+		addTestProfile(t, s, pid)
+		pids = append(pids, pid)
+	}
+
+	// Profiles added before the index was maintained
+	for _, pid := range pids {
+		if err := s.unindexProfile(pid); err != nil {
+			t.Fatalf("unindexProfile: %s", err)
+		}
+	}
+	s.Close()
+
+	s, err := NewRedisStore(testRedisConfig(t), nil)
+	if err != nil {
+		t.Fatalf("NewRedisStore: %s", err)
+	}
+	defer s.Close()
+
+	if profiles, err := s.SearchProfiles("*", 0, 0); err != nil || len(profiles) != len(pids) {
+		t.Errorf("SearchProfiles = %d profiles, %v, want %d", len(profiles), err, len(pids))
+	}
+	if profiles, err := s.SearchProfiles("user0042", 0, 0); err != nil || len(profiles) != 1 || profiles[0].Pid != "user0042" {
+		t.Errorf("SearchProfiles(user0042) = %v, %v", profiles, err)
+	}
+}
+
+func TestRebuildSearchIndexOtherKeys(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		// Keys of the index and of suggested profiles that end in ":info"
+		addTestProfile(t, s, "alice")
+		addTestProfile(t, s, "info")
+		if err := s.UpdateProfile("alice", map[string]string{"bio": "information"}); err != nil {
+			t.Fatalf("UpdateProfile: %s", err)
+		}
+		if err := s.AddSuggestedProfile("alice", "info"); err != nil {
+			t.Fatalf("AddSuggestedProfile: %s", err)
+		}
+
+		if n, err := s.RebuildSearchIndex(); err != nil || n != 2 {
+			t.Fatalf("RebuildSearchIndex = %d, %v, want 2", n, err)
+		}
+
+		if profiles, err := s.SearchProfiles("*", 0, 0); err != nil || len(profiles) != 2 {
+			t.Errorf("SearchProfiles(*) = %d profiles, %v, want 2", len(profiles), err)
+		}
+		if profiles, err := s.SearchProfiles("info", 0, 0); err != nil || len(profiles) != 2 || profiles[0].Pid != "info" {
+			t.Errorf("SearchProfiles(info) = %v, %v, want info then alice", profiles, err)
+		}
+		for _, query := range []string{"suggestedprofiles", "search"} {
+			if profiles, err := s.SearchProfiles(query, 0, 0); err != nil || len(profiles) != 0 {
+				t.Errorf("SearchProfiles(%s) = %v, %v, want none", query, profiles, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,564 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Each session is a key holding the pid it belongs to, which expires when the
+// session hasn't been used for the configured lifetime. Sessions are keyed by
+// the SHA-256 of the token handed to the client so the tokens can't be
+// recovered from the database. The sessions for a pid are indexed by a sorted
+// set scored by when each was last seen, with their creation times in a
+// separate hash. The pids with indexed sessions are kept in a set so the
+// indexes can be swept.
+//
+// Sessions created before tokens were introduced are keyed by their numeric
+// id. They remain valid, without their lifetime being extended, until they
+// expire. They had no lifetime, so NewRedisStore gives them one and indexes
+// them the first time it opens a session database.
+
+const sessionTokenBytes = 32
+
+// Pids that have a sessions index
+const SESSION_PIDS = "sessionpids"
+
+// Set once legacy sessions have been given a lifetime and indexed
+const LEGACY_SESSIONS_INDEXED = "legacysessionsindexed"
+
+// Removes pid from SESSION_PIDS once it has no indexed sessions
+// KEYS: sessions index, SESSION_PIDS
+// ARGV: pid
+var unindexSessionPidScript = newLuaScript(`
+if redis.call('ZCARD', KEYS[1]) == 0 then
+	return redis.call('SREM', KEYS[2], ARGV[1])
+end
+return 0
+`)
+
+type Session struct {
+	Id       string    `json:"id"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"lastseen"`
+}
+
+func sessionsKey(pid PidType) string {
+	return fmt.Sprintf("sessions:%s", pid)
+}
+
+func sessionsCreatedKey(pid PidType) string {
+	return fmt.Sprintf("sessions:%s:created", pid)
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, sessionTokenBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// Returns the id under which a token is stored, so that the token itself
+// can't be recovered from the database
+func tokenId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Returns the id under which the session for token is stored. Legacy
+// sessions are stored under the token itself.
+func sessionTokenId(token string) string {
+	if isLegacySessionToken(token) {
+		return token
+	}
+	return tokenId(token)
+}
+
+func isLegacySessionToken(token string) bool {
+	_, err := strconv.ParseInt(token, 10, 64)
+	return err == nil
+}
+
+// Starts a session for pid, returning the token that identifies it
+func (s *RedisStore) SessionId(pid PidType) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	id := sessionTokenId(token)
+	now := time.Now().UnixNano()
+
+	rs := s.sdb.Command("SET", sessionKey(id), pid, "EX", s.config.Sessions.Lifetime)
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	rs = s.sdb.Command("ZADD", sessionsKey(pid), now, id)
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	rs = s.sdb.Command("HSET", sessionsCreatedKey(pid), id, now)
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	rs = s.sdb.Command("SADD", SESSION_PIDS, pid)
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
+	return token, nil
+}
+
+// Reports whether the session exists and belongs to pid. Using a session
+// extends its lifetime.
+func (s *RedisStore) ValidSession(pid PidType, token string) (bool, error) {
+	id := sessionTokenId(token)
+
+	rs := s.sdb.Command("GET", sessionKey(id))
+	if !rs.IsOK() {
+		if isKeyNotFound(rs.Error()) {
+			return false, nil
+		}
+		return false, rs.Error()
+	}
+
+	if PidType(rs.ValueAsString()) != pid {
+		return false, nil
+	}
+
+	if !isLegacySessionToken(token) {
+		rs = s.sdb.Command("EXPIRE", sessionKey(id), s.config.Sessions.Lifetime)
+		if !rs.IsOK() {
+			return false, rs.Error()
+		}
+	}
+
+	rs = s.sdb.Command("ZADD", sessionsKey(pid), time.Now().UnixNano(), id)
+	if !rs.IsOK() {
+		return false, rs.Error()
+	}
+
+	// Legacy sessions are indexed when first used
+	if isLegacySessionToken(token) {
+		rs = s.sdb.Command("SADD", SESSION_PIDS, pid)
+		if !rs.IsOK() {
+			return false, rs.Error()
+		}
+	}
+
+	return true, nil
+}
+
+// Ends the session identified by token
+func (s *RedisStore) Logout(pid PidType, token string) error {
+	return s.RevokeSession(pid, sessionTokenId(token))
+}
+
+// Ends a session belonging to pid given the id reported by Sessions
+func (s *RedisStore) RevokeSession(pid PidType, id string) error {
+	rs := s.sdb.Command("GET", sessionKey(id))
+	if rs.IsOK() && PidType(rs.ValueAsString()) == pid {
+		rs = s.sdb.Command("DEL", sessionKey(id))
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+	} else if !rs.IsOK() && !isKeyNotFound(rs.Error()) {
+		return rs.Error()
+	}
+
+	return s.unindexSession(pid, id)
+}
+
+// Ends every session belonging to pid, returning the number that were active
+func (s *RedisStore) LogoutAll(pid PidType) (int, error) {
+	rs := s.sdb.Command("ZRANGE", sessionsKey(pid), 0, -1)
+	if !rs.IsOK() {
+		return 0, rs.Error()
+	}
+
+	n := 0
+	for _, id := range rs.ValuesAsStrings() {
+		rs := s.sdb.Command("GET", sessionKey(id))
+		if !rs.IsOK() || PidType(rs.ValueAsString()) != pid {
+			continue
+		}
+
+		rs = s.sdb.Command("DEL", sessionKey(id))
+		if !rs.IsOK() {
+			return n, rs.Error()
+		}
+		n++
+	}
+
+	rs = s.sdb.Command("DEL", sessionsKey(pid), sessionsCreatedKey(pid))
+	if !rs.IsOK() {
+		return n, rs.Error()
+	}
+
+	rs = s.sdb.Command("SREM", SESSION_PIDS, pid)
+	if !rs.IsOK() {
+		return n, rs.Error()
+	}
+
+	return n, nil
+}
+
+// Lists the active sessions for pid, most recently used first
+func (s *RedisStore) Sessions(pid PidType) ([]*Session, error) {
+	sessions := make([]*Session, 0)
+
+	rs := s.sdb.Command("ZREVRANGE", sessionsKey(pid), 0, -1, "WITHSCORES")
+	if !rs.IsOK() {
+		return sessions, rs.Error()
+	}
+
+	vals := rs.ValuesAsStrings()
+	for i := 0; i+1 < len(vals); i += 2 {
+		id := vals[i]
+
+		// Entries outlive their sessions until the next sweep
+		rs := s.sdb.Command("GET", sessionKey(id))
+		if !rs.IsOK() || PidType(rs.ValueAsString()) != pid {
+			continue
+		}
+
+		session := &Session{Id: id}
+		if lastSeen, err := strconv.ParseFloat(vals[i+1], 64); err == nil {
+			session.LastSeen = time.Unix(0, int64(lastSeen))
+		}
+
+		rs = s.sdb.Command("HGET", sessionsCreatedKey(pid), id)
+		if rs.IsOK() {
+			if created, err := strconv.ParseInt(rs.ValueAsString(), 10, 64); err == nil {
+				session.Created = time.Unix(0, created)
+			}
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func (s *RedisStore) unindexSession(pid PidType, id string) error {
+	rs := s.sdb.Command("ZREM", sessionsKey(pid), id)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	rs = s.sdb.Command("HDEL", sessionsCreatedKey(pid), id)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// SweepSessions tidies the session indexes. Index entries for expired
+// sessions are removed and the sessions of missing profiles are deleted.
+// Returns the number of sessions and index entries removed.
+func (s *RedisStore) SweepSessions() (int, error) {
+	n := 0
+
+	err := scanSet(s.sdb, SESSION_PIDS, func(pids []string) error {
+		for _, p := range pids {
+			pid := PidType(p)
+
+			if exists, err := s.ProfileExists(pid); err != nil {
+				return err
+			} else if !exists {
+				removed, err := s.LogoutAll(pid)
+				n += removed
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			rs := s.sdb.Command("ZRANGE", sessionsKey(pid), 0, -1)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+
+			for _, id := range rs.ValuesAsStrings() {
+				if keyExists(s.sdb, sessionKey(id)) {
+					continue
+				}
+				if err := s.unindexSession(pid, id); err != nil {
+					return err
+				}
+				n++
+			}
+
+			rs = unindexSessionPidScript.run(s.sdb, []string{sessionsKey(pid), SESSION_PIDS}, pid)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+		}
+		return nil
+	})
+
+	return n, err
+}
+
+// Gives sessions created before expiry was introduced a lifetime and indexes
+// them, and deletes those belonging to missing profiles. Returns the number
+// indexed. Only needed once for a session database that predates the index,
+// since it scans every session, and run by NewRedisStore when it hasn't been.
+func (s *RedisStore) IndexLegacySessions() (int, error) {
+	n := 0
+
+	err := scanKeys(s.sdb, sessionKey("*"), func(keys []string) error {
+		for _, key := range keys {
+			id := strings.TrimPrefix(key, sessionKey(""))
+
+			rs := s.sdb.Command("GET", key)
+			if !rs.IsOK() {
+				continue
+			}
+			pid := PidType(rs.ValueAsString())
+
+			if exists, err := s.ProfileExists(pid); err != nil {
+				return err
+			} else if !exists {
+				rs = s.sdb.Command("DEL", key)
+				if !rs.IsOK() {
+					return rs.Error()
+				}
+				continue
+			}
+
+			rs = s.sdb.Command("TTL", key)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+			if ttl, _ := rs.ValueAsInt(); ttl >= 0 {
+				continue
+			}
+
+			now := time.Now().UnixNano()
+
+			rs = s.sdb.Command("EXPIRE", key, s.config.Sessions.Lifetime)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+
+			rs = s.sdb.Command("ZADD", sessionsKey(pid), now, id)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+
+			rs = s.sdb.Command("HSETNX", sessionsCreatedKey(pid), id, now)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+
+			rs = s.sdb.Command("SADD", SESSION_PIDS, pid)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+			n++
+		}
+		return nil
+	})
+
+	return n, err
+}
+
+// Indexes legacy sessions the first time the store is opened after sessions
+// were indexed, so they expire without anyone running IndexLegacySessions
+func (s *RedisStore) ensureLegacySessionsIndexed() error {
+	rs := s.sdb.Command("EXISTS", LEGACY_SESSIONS_INDEXED)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+	if exists, _ := rs.ValueAsBool(); exists {
+		return nil
+	}
+
+	n, err := s.IndexLegacySessions()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		applog.Infof("Indexed %d legacy sessions", n)
+	}
+
+	rs = s.sdb.Command("SET", LEGACY_SESSIONS_INDEXED, time.Now().Unix())
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) sessionLifetime() time.Duration {
+	return time.Duration(s.config.Sessions.Lifetime) * time.Second
+}
+
+func (s *MemoryStore) SessionId(pid PidType) (string, error) {
+	token, err := newSessionToken()
+	if err != nil {
+		return "", err
+	}
+
+	id := sessionTokenId(token)
+	now := time.Now().UnixNano()
+
+	s.sdb.set(sessionKey(id), string(pid))
+	s.sdb.expire(sessionKey(id), s.sessionLifetime())
+	s.sdb.zadd(sessionsKey(pid), float64(now), id)
+	s.sdb.hset(sessionsCreatedKey(pid), id, strconv.FormatInt(now, 10))
+	s.sdb.sadd(SESSION_PIDS, string(pid))
+
+	return token, nil
+}
+
+func (s *MemoryStore) ValidSession(pid PidType, token string) (bool, error) {
+	id := sessionTokenId(token)
+
+	val, err := s.sdb.get(sessionKey(id))
+	if err != nil || PidType(val) != pid {
+		return false, nil
+	}
+
+	if !isLegacySessionToken(token) {
+		s.sdb.expire(sessionKey(id), s.sessionLifetime())
+	}
+	s.sdb.zadd(sessionsKey(pid), float64(time.Now().UnixNano()), id)
+	if isLegacySessionToken(token) {
+		s.sdb.sadd(SESSION_PIDS, string(pid))
+	}
+
+	return true, nil
+}
+
+func (s *MemoryStore) Logout(pid PidType, token string) error {
+	return s.RevokeSession(pid, sessionTokenId(token))
+}
+
+func (s *MemoryStore) RevokeSession(pid PidType, id string) error {
+	if val, err := s.sdb.get(sessionKey(id)); err == nil && PidType(val) == pid {
+		s.sdb.del(sessionKey(id))
+	}
+
+	s.sdb.zrem(sessionsKey(pid), id)
+	s.sdb.hdel(sessionsCreatedKey(pid), id)
+
+	return nil
+}
+
+func (s *MemoryStore) LogoutAll(pid PidType) (int, error) {
+	n := 0
+	for _, m := range s.sdb.zrange(sessionsKey(pid), 0, -1) {
+		if val, err := s.sdb.get(sessionKey(m.member)); err == nil && PidType(val) == pid {
+			s.sdb.del(sessionKey(m.member))
+			n++
+		}
+	}
+
+	s.sdb.del(sessionsKey(pid), sessionsCreatedKey(pid))
+	s.sdb.srem(SESSION_PIDS, string(pid))
+
+	return n, nil
+}
+
+func (s *MemoryStore) Sessions(pid PidType) ([]*Session, error) {
+	sessions := make([]*Session, 0)
+
+	members := s.sdb.zrange(sessionsKey(pid), 0, -1)
+	for i := len(members) - 1; i >= 0; i-- {
+		m := members[i]
+
+		if val, err := s.sdb.get(sessionKey(m.member)); err != nil || PidType(val) != pid {
+			continue
+		}
+
+		session := &Session{Id: m.member, LastSeen: time.Unix(0, int64(m.score))}
+		if val, err := s.sdb.hget(sessionsCreatedKey(pid), m.member); err == nil {
+			if created, err := strconv.ParseInt(val, 10, 64); err == nil {
+				session.Created = time.Unix(0, created)
+			}
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+func (s *MemoryStore) SweepSessions() (int, error) {
+	n := 0
+
+	for _, p := range s.sdb.smembers(SESSION_PIDS) {
+		pid := PidType(p)
+
+		if exists, _ := s.ProfileExists(pid); !exists {
+			removed, _ := s.LogoutAll(pid)
+			n += removed
+			continue
+		}
+
+		for _, m := range s.sdb.zrange(sessionsKey(pid), 0, -1) {
+			if s.sdb.exists(sessionKey(m.member)) {
+				continue
+			}
+			s.sdb.zrem(sessionsKey(pid), m.member)
+			s.sdb.hdel(sessionsCreatedKey(pid), m.member)
+			n++
+		}
+
+		if len(s.sdb.zrange(sessionsKey(pid), 0, -1)) == 0 {
+			s.sdb.srem(SESSION_PIDS, string(pid))
+		}
+	}
+
+	return n, nil
+}
+
+func (s *MemoryStore) IndexLegacySessions() (int, error) {
+	n := 0
+
+	sessionKeys := s.sdb.keys(func(key string) bool {
+		return strings.HasPrefix(key, sessionKey(""))
+	})
+	for _, key := range sessionKeys {
+		id := strings.TrimPrefix(key, sessionKey(""))
+
+		val, err := s.sdb.get(key)
+		if err != nil {
+			continue
+		}
+		pid := PidType(val)
+
+		if exists, _ := s.ProfileExists(pid); !exists {
+			s.sdb.del(key)
+			continue
+		}
+
+		if s.sdb.hasExpiry(key) {
+			continue
+		}
+
+		now := time.Now().UnixNano()
+		s.sdb.expire(key, s.sessionLifetime())
+		s.sdb.zadd(sessionsKey(pid), float64(now), id)
+		if _, err := s.sdb.hget(sessionsCreatedKey(pid), id); err != nil {
+			s.sdb.hset(sessionsCreatedKey(pid), id, strconv.FormatInt(now, 10))
+		}
+		s.sdb.sadd(SESSION_PIDS, string(pid))
+		n++
+	}
+
+	return n, nil
+}
@@ -0,0 +1,134 @@
+package datastore
+
+import (
+	"testing"
+)
+
+// Stores a session the way it was before tokens and expiry were introduced
+func addLegacyTestSession(t *testing.T, s Store, id string, pid PidType) {
+	switch s := s.(type) {
+	case *RedisStore:
+		if rs := s.sdb.Command("SET", sessionKey(id), pid); !rs.IsOK() {
+			t.Fatalf("SET: %s", rs.Error())
+		}
+	case *MemoryStore:
+		s.sdb.set(sessionKey(id), string(pid))
+	}
+}
+
+func TestSweepSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		addTestProfile(t, s, "bob")
+
+		token, err := s.SessionId("alice")
+		if err != nil {
+			t.Fatalf("SessionId: %s", err)
+		}
+		if valid, err := s.ValidSession("alice", token); err != nil || !valid {
+			t.Fatalf("ValidSession = %v, %v", valid, err)
+		}
+		if _, err := s.SessionId("bob"); err != nil {
+			t.Fatalf("SessionId: %s", err)
+		}
+
+		addLegacyTestSession(t, s, "12345", "alice")
+		addLegacyTestSession(t, s, "12346", "nobody")
+
+		n, err := s.IndexLegacySessions()
+		if err != nil || n != 1 {
+			t.Fatalf("IndexLegacySessions = %d, %v, want 1", n, err)
+		}
+		if valid, err := s.ValidSession("nobody", "12346"); err != nil || valid {
+			t.Errorf("session of a missing profile is valid: %v, %v", valid, err)
+		}
+		if sessions, err := s.Sessions("alice"); err != nil || len(sessions) != 2 {
+			t.Errorf("Sessions = %d, %v, want 2", len(sessions), err)
+		}
+
+		// bob's profile has gone and alice's legacy session has ended
+		if _, err := s.DeleteProfile("bob"); err != nil {
+			t.Fatalf("DeleteProfile: %s", err)
+		}
+		if _, err := s.SessionId("bob"); err != nil {
+			t.Fatalf("SessionId: %s", err)
+		}
+		if err := s.RevokeSession("alice", "12345"); err != nil {
+			t.Fatalf("RevokeSession: %s", err)
+		}
+		addLegacyTestSession(t, s, "12345", "alice")
+		if valid, err := s.ValidSession("alice", "12345"); err != nil || !valid {
+			t.Fatalf("ValidSession = %v, %v", valid, err)
+		}
+		switch s := s.(type) {
+		case *RedisStore:
+			s.sdb.Command("DEL", sessionKey("12345"))
+		case *MemoryStore:
+			s.sdb.del(sessionKey("12345"))
+		}
+
+		n, err = s.SweepSessions()
+		if err != nil || n != 2 {
+			t.Fatalf("SweepSessions = %d, %v, want 2", n, err)
+		}
+		if sessions, err := s.Sessions("alice"); err != nil || len(sessions) != 1 {
+			t.Errorf("Sessions = %d, %v, want 1", len(sessions), err)
+		}
+		if valid, err := s.ValidSession("alice", token); err != nil || !valid {
+			t.Errorf("ValidSession = %v, %v after sweep", valid, err)
+		}
+	})
+}
+
+func TestZeroLifetimes(t *testing.T) {
+	zero := func(config Config) Config {
+		config.Sessions.Lifetime = 0
+		config.Account.ResetLifetime = 0
+		config.Account.VerifyLifetime = 0
+		config.OAuth.StateLifetime = 0
+		return config
+	}
+
+	if c := NewMemoryStore(zero(testConfig("")), nil).config; c.Sessions != DefaultConfig.Sessions || c.Account != DefaultConfig.Account || c.OAuth != DefaultConfig.OAuth {
+		t.Errorf("lifetimes = %+v %+v %+v, want the defaults", c.Sessions, c.Account, c.OAuth)
+	}
+
+	s := newTestRedisStoreFrom(t, zero(testRedisConfig(t)))
+	defer s.Close()
+
+	addTestProfile(t, s, "alice")
+	token, err := s.SessionId("alice")
+	if err != nil {
+		t.Fatalf("SessionId: %s", err)
+	}
+	if valid, err := s.ValidSession("alice", token); err != nil || !valid {
+		t.Errorf("ValidSession = %v, %v", valid, err)
+	}
+}
+
+func TestLegacySessionsOnStartup(t *testing.T) {
+	s := newTestRedisStore(t)
+	addTestProfile(t, s, "alice")
+	addLegacyTestSession(t, s, "12345", "alice")
+
+	// A session database from before sessions were indexed
+	s.sdb.Command("DEL", LEGACY_SESSIONS_INDEXED)
+	s.Close()
+
+	s, err := NewRedisStore(testRedisConfig(t), nil)
+	if err != nil {
+		t.Fatalf("NewRedisStore: %s", err)
+	}
+	defer s.Close()
+
+	rs := s.sdb.Command("TTL", sessionKey("12345"))
+	if ttl, _ := rs.ValueAsInt(); !rs.IsOK() || ttl <= 0 {
+		t.Errorf("legacy session has TTL %s, want a lifetime", rs.ValueAsString())
+	}
+	if sessions, err := s.Sessions("alice"); err != nil || len(sessions) != 1 {
+		t.Errorf("Sessions = %d, %v, want 1", len(sessions), err)
+	}
+	if valid, err := s.ValidSession("alice", "12345"); err != nil || !valid {
+		t.Errorf("ValidSession = %v, %v", valid, err)
+	}
+}
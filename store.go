@@ -2,22 +2,13 @@ package datastore
 
 import (
 	"cgl.tideland.biz/applog"
-	"code.google.com/p/go.crypto/bcrypt"
 	"code.google.com/p/tcgl/redis"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
-	"github.com/iand/salience"
-	"image"
-	_ "image/jpeg"
-	"image/png"
 	"io"
 	"log"
-	"math/rand"
-	"net/http"
-	"os"
-	"path"
-	"regexp"
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -27,9 +18,12 @@ const (
 	FEED_DRIVEN_PROFILES = "feeddrivenprofiles"
 	ITEMS_NEEDING_IMAGES = "itemsneedingimages"
 	FLAGGED_PROFILES     = "flaggedprofiles"
+	SUGGESTED_LOCATIONS  = "suggestedlocations"
 	ITEM_ID              = "itemid"
 	MaxInt               = int(^uint(0) >> 1)
 
+	scanBatchSize = 1000
+
 	ORDERING_TS = "ts"
 
 	// EVENTED_ITEM_PREFIX = '+'
@@ -40,11 +34,6 @@ const (
 	FeedTypeEventful = "eventful"
 )
 
-var (
-	store             *RedisStore
-	ProfileProperties = []string{"name", "feedurl", "bio", "email", "parentpid", "joined", "location", "url", "profileimageurl", "profileimageurlhttps"}
-)
-
 type PidType string
 
 func (p PidType) String() string {
@@ -57,58 +46,86 @@ func (i ItemIdType) String() string {
 	return strings.ToLower(string(i))
 }
 
-func InitRedisStore(config Config, imgpath string) {
+// NewRedisStore connects to the databases described by config and returns a
+// store that uses them. Each call returns an independent store with its own
+// connection pools which must be released with Close. Changes to followers'
+// timelines are queued and applied by workers that the store starts, unless
+// config.Fanout.NoWorkers is set, in which case StartFanoutWorkers must be
+// called by at least one other process. Images for items are cached in
+// images.
+func NewRedisStore(config Config, images ImageStore) (*RedisStore, error) {
+	applog.Infof("Connecting to datastores")
+
+	config = config.withDefaults()
+	s := &RedisStore{
+		config:  config,
+		images:  images,
+		fetcher: NewSafeFetcher(config.Fetch),
+	}
+
+	var err error
+
 	// Contains all profiles and meta stuff
-	profiledb := redis.Connect(redis.Configuration{
-		Database: config.Profile.Database,
-		Address:  config.Profile.Address,
-		PoolSize: config.Profile.PoolSize,
-		Timeout:  10 * time.Second,
-	})
+	if s.pdb, err = connectDatabase(DB_PROFILE, config.Profile); err != nil {
+		s.Close()
+		return nil, err
+	}
 
 	// Contains all timelines
-	timelinedb := redis.Connect(redis.Configuration{
-		Database: config.Timeline.Database,
-		Address:  config.Timeline.Address,
-		PoolSize: config.Timeline.PoolSize,
-		Timeout:  10 * time.Second,
-	})
+	if s.tdb, err = connectDatabase(DB_TIMELINE, config.Timeline); err != nil {
+		s.Close()
+		return nil, err
+	}
 
 	// Contains all items
-	itemdb := redis.Connect(redis.Configuration{
-		Database: config.Item.Database,
-		Address:  config.Item.Address,
-		PoolSize: config.Item.PoolSize,
-		Timeout:  10 * time.Second,
-	})
+	if s.idb, err = connectDatabase(DB_ITEM, config.Item); err != nil {
+		s.Close()
+		return nil, err
+	}
 
 	// Contains session information
-	sessiondb := redis.Connect(redis.Configuration{
-		Database: config.Session.Database,
-		Address:  config.Session.Address,
-		PoolSize: config.Session.PoolSize,
-		Timeout:  10 * time.Second,
-	})
+	if s.sdb, err = connectDatabase(DB_SESSION, config.Session); err != nil {
+		s.Close()
+		return nil, err
+	}
 
-	applog.Infof("Connecting to datastores")
-	applog.Infof("Profile datastore: %s/%d", config.Profile.Address, config.Profile.Database)
-	applog.Infof("Timeline datastore: %s/%d", config.Timeline.Address, config.Timeline.Database)
-	applog.Infof("Item datastore: %s/%d", config.Item.Address, config.Item.Database)
-	applog.Infof("Session datastore: %s/%d", config.Session.Address, config.Session.Database)
+	if err := s.ensureSearchIndex(); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if err := s.ensureLegacySessionsIndexed(); err != nil {
+		s.Close()
+		return nil, err
+	}
 
-	store = &RedisStore{
-		tdb:     timelinedb,
-		idb:     itemdb,
-		pdb:     profiledb,
-		sdb:     sessiondb,
-		imgpath: imgpath,
+	if !config.Fanout.NoWorkers {
+		if err := s.StartFanoutWorkers(); err != nil {
+			s.Close()
+			return nil, err
+		}
 	}
 
+	return s, nil
 }
 
-func NewRedisStore() *RedisStore {
-	return store
+func connectDatabase(name string, config RedisConfig) (*redis.Database, error) {
+	db := redis.Connect(redis.Configuration{
+		Database: config.Database,
+		Address:  config.Address,
+		Auth:     config.Auth,
+		PoolSize: config.PoolSize,
+		Timeout:  10 * time.Second,
+	})
+
+	rs := db.Command("PING")
+	if !rs.IsOK() {
+		db.Close()
+		return nil, fmt.Errorf("could not connect to %s datastore at %s/%d: %s", name, config.Address, config.Database, rs.Error())
+	}
 
+	applog.Infof("%s datastore: %s/%d", name, config.Address, config.Database)
+	return db, nil
 }
 
 type RedisStore struct {
@@ -116,7 +133,11 @@ type RedisStore struct {
 	idb     *redis.Database
 	pdb     *redis.Database
 	sdb     *redis.Database
-	imgpath string
+	config  Config
+	images  ImageStore
+	fetcher Fetcher
+	fanout  *fanoutWorkers
+	imager  *imageWorkers
 }
 
 func itemScore(t time.Time) float64 {
@@ -139,6 +160,10 @@ func pidFromKey(key string) PidType {
 
 }
 
+func itemIdFromKey(itemKey string) ItemIdType {
+	return ItemIdType(strings.TrimPrefix(itemKey, "item:"))
+}
+
 func feedsKey(pid PidType) string {
 	return fmt.Sprintf("%s:feeds", pid)
 }
@@ -179,20 +204,76 @@ func suggestedProfileKey(loc string) string {
 	return fmt.Sprintf("suggestedprofiles:%s", loc)
 }
 
-func sessionKey(num int64) string {
-	return fmt.Sprintf("session:%d", num)
+// The items a profile has authored, in the item database
+func authoredKey(pid PidType) string {
+	return fmt.Sprintf("%s:items", pid)
+}
+
+func sessionKey(id string) string {
+	return fmt.Sprintf("session:%s", id)
 }
 
 func oauthSessionKey(key string) string {
 	return fmt.Sprintf("oauth:%s", key)
 }
 
+// The profiles other than the author that have promoted an item
+func promotersKey(itemKey string) string {
+	return fmt.Sprintf("%s:promoters", itemKey)
+}
+
 func sourcesKey(pid PidType) string {
 	return fmt.Sprintf("%s:sources", pid)
 }
 
+func valuesToHash(vals []string) map[string]string {
+	hash := make(map[string]string, len(vals)/2)
+	for i := 0; i < len(vals)-1; i += 2 {
+		hash[vals[i]] = vals[i+1]
+	}
+	return hash
+}
+
+func profileFromHash(pid PidType, hash map[string]string) *Profile {
+	p := &Profile{}
+	profileCodec.decode(hash, p)
+	p.Pid = pid
+	return p
+}
+
+func briefProfileFromHash(pid PidType, hash map[string]string) *BriefProfile {
+	p := &BriefProfile{}
+	briefProfileCodec.decode(hash, p)
+	p.Pid = pid
+	return p
+}
+
+// Flattens a hash into the arguments of HMSET
+func hashArgs(key interface{}, hash map[string]string) []interface{} {
+	args := make([]interface{}, 0, len(hash)*2+1)
+	args = append(args, key)
+	for k, v := range hash {
+		args = append(args, k, v)
+	}
+	return args
+}
+
+// Close releases the connection pools held by the store. The store must not
+// be used after it has been closed.
 func (s *RedisStore) Close() {
+	s.stopFanoutWorkers()
+	s.stopImageWorkers()
+	for _, db := range []*redis.Database{s.pdb, s.tdb, s.idb, s.sdb} {
+		if db != nil {
+			db.Close()
+		}
+	}
+	s.pdb, s.tdb, s.idb, s.sdb = nil, nil, nil, nil
+}
 
+// Replaces the fetcher used to read remote images and pages
+func (s *RedisStore) SetFetcher(fetcher Fetcher) {
+	s.fetcher = fetcher
 }
 
 func (s *RedisStore) SuggestedProfiles(loc string) ([]*Profile, error) {
@@ -219,7 +300,12 @@ func (s *RedisStore) SuggestedProfiles(loc string) ([]*Profile, error) {
 }
 
 func (s *RedisStore) AddSuggestedProfile(pid PidType, loc string) error {
-	rs := s.pdb.Command("SADD", suggestedProfileKey(loc), pid)
+	rs := s.pdb.Command("SADD", SUGGESTED_LOCATIONS, loc)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	rs = s.pdb.Command("SADD", suggestedProfileKey(loc), pid)
 	if !rs.IsOK() {
 		return rs.Error()
 	}
@@ -252,49 +338,14 @@ func (s *RedisStore) Profile(pid PidType) (*Profile, error) {
 		return nil, rs.Error()
 	}
 
-	p := Profile{
-		Pid: pid,
-	}
-	vals := rs.ValuesAsStrings()
-
-	for i := 0; i < len(vals)-1; i += 2 {
-		switch vals[i] {
-		case "name":
-			p.Name = vals[i+1]
-		case "bio":
-			p.Bio = vals[i+1]
-		case "feedtype":
-			p.FeedType = vals[i+1]
-		case "feedurl":
-			p.FeedUrl = vals[i+1]
-		case "parentpid":
-			p.ParentPid = PidType(vals[i+1])
-		case "email":
-			p.Email = vals[i+1]
-		case "location":
-			p.Location = vals[i+1]
-		case "url":
-			p.Url = vals[i+1]
-		case "profileimageurl":
-			p.ProfileImageUrl = vals[i+1]
-		case "profileimageurlhttps":
-			p.ProfileImageUrlHttps = vals[i+1]
-		case "itemtype":
-			p.ItemType = vals[i+1]
-		case "joined":
-			if v, err := strconv.ParseInt(vals[i+1], 10, 64); err == nil {
-				p.Joined = v
-			}
-
-		}
-	}
+	p := profileFromHash(pid, valuesToHash(rs.ValuesAsStrings()))
 
-	rs = s.pdb.Command("ZCARD", possiblyKey(pid, ORDERING_TS))
+	rs = s.tdb.Command("ZCARD", possiblyKey(pid, ORDERING_TS))
 	if rs.IsOK() {
 		p.PossiblyCount, _ = rs.ValueAsInt()
 	}
 
-	rs = s.pdb.Command("ZCARD", maybeKey(pid, ORDERING_TS))
+	rs = s.tdb.Command("ZCARD", maybeKey(pid, ORDERING_TS))
 	if rs.IsOK() {
 		p.MaybeCount, _ = rs.ValueAsInt()
 	}
@@ -314,7 +365,7 @@ func (s *RedisStore) Profile(pid PidType) (*Profile, error) {
 		p.FeedCount, _ = rs.ValueAsInt()
 	}
 
-	return &p, nil
+	return p, nil
 }
 
 func (s *RedisStore) BriefProfile(pid PidType) (*BriefProfile, error) {
@@ -323,33 +374,41 @@ func (s *RedisStore) BriefProfile(pid PidType) (*BriefProfile, error) {
 		return nil, rs.Error()
 	}
 
-	p := BriefProfile{
-		Pid: pid,
-	}
-	vals := rs.ValuesAsStrings()
-
-	for i := 0; i < len(vals)-1; i += 2 {
-		switch vals[i] {
-		case "name":
-			p.Name = vals[i+1]
-		case "profileimageurlhttps":
-			p.ProfileImageUrlHttps = vals[i+1]
-		}
-	}
-
-	return &p, nil
+	return briefProfileFromHash(pid, valuesToHash(rs.ValuesAsStrings())), nil
 }
 
 func (s *RedisStore) AddProfile(pid PidType, password string, pname string, bio string, feedtype string, feedurl string, parentpid PidType, email string, location string, url string, profileImageUrl string, profileImageUrlHttps string, itemType string) error {
-	pwdhash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	pwdhash, err := hashPassword(password, s.config.Passwords)
 	if err != nil {
 		return err
 	}
 
-	joined := time.Now().Unix()
-	rs := s.pdb.Command("HMSET", profileKey(pid), "name", pname, "bio", bio, "feedtype", feedtype, "feedurl", feedurl, "pwdhash", pwdhash, "parentpid", parentpid, "email", email, "joined", joined, "location", location, "url", url, "profileimageurl", profileImageUrl, "profileimageurlhttps", profileImageUrlHttps, "itemtype", itemType)
+	if err := s.indexEmail(pid, email); err != nil {
+		return err
+	}
+
+	p := &Profile{
+		Name:                 pname,
+		PasswordHash:         pwdhash,
+		Bio:                  bio,
+		Email:                email,
+		Joined:               time.Now().Unix(),
+		Location:             location,
+		Url:                  url,
+		ProfileImageUrl:      profileImageUrl,
+		ProfileImageUrlHttps: profileImageUrlHttps,
+		FeedType:             feedtype,
+		FeedUrl:              feedurl,
+		ParentPid:            parentpid,
+		ItemType:             itemType,
+	}
 
+	rs := s.pdb.Command("HMSET", hashArgs(profileKey(pid), profileCodec.encode(p))...)
 	if !rs.IsOK() {
+		// Release the address reserved above
+		if err := s.unindexEmail(pid, email); err != nil {
+			applog.Errorf("Could not release email of %s: %s", pid, err.Error())
+		}
 		return rs.Error()
 	}
 
@@ -366,105 +425,109 @@ func (s *RedisStore) AddProfile(pid PidType, password string, pname string, bio
 		}
 	}
 
-	return nil
+	if err := s.indexProfile(pid); err != nil {
+		return err
+	}
 
+	return nil
 }
 
+// Changes the given fields of a profile. Only the fields listed in
+// ProfileProperties may be changed; a *ProfileFieldError is returned for any
+// other key and nothing is changed. Changing the email address fails with
+// ErrEmailInUse if another profile has it, and otherwise clears EmailVerified.
+// Changing parentpid moves the profile from the old parent's feeds to the new
+// parent's.
 func (s *RedisStore) UpdateProfile(pid PidType, values map[string]string) error {
-	params := make([]interface{}, 0)
-	params = append(params, profileKey(pid))
-	for k, v := range values {
-		params = append(params, k, v)
+	if err := profileCodec.validate(values); err != nil {
+		return err
 	}
 
-	if len(params) <= 1 {
+	if len(values) == 0 {
 		return nil
 	}
 
-	rs := s.pdb.Command("HMSET", params...)
-	if !rs.IsOK() {
-		return rs.Error()
-	}
-
-	if feedurl, exists := values["feedurl"]; exists && feedurl != "" {
-		// TODO: remove pid if feedurl is empty
-		rs := s.pdb.Command("SADD", FEED_DRIVEN_PROFILES, pid)
-		if !rs.IsOK() {
+	parentpid, changingParent := values["parentpid"]
+	oldParent := ""
+	if changingParent {
+		rs := s.pdb.Command("HGET", profileKey(pid), "parentpid")
+		if rs.IsOK() {
+			oldParent = rs.ValueAsString()
+		} else if !isKeyNotFound(rs.Error()) {
 			return rs.Error()
 		}
 	}
 
-	if parentpid, exists := values["parentpid"]; exists && parentpid != "" {
-		rs := s.pdb.Command("SADD", feedsKey(PidType(parentpid)), pid)
-		if !rs.IsOK() {
+	email, changingEmail := values["email"]
+	oldEmail := ""
+	if changingEmail {
+		rs := s.pdb.Command("HGET", profileKey(pid), "email")
+		if rs.IsOK() {
+			oldEmail = rs.ValueAsString()
+		} else if !isKeyNotFound(rs.Error()) {
 			return rs.Error()
 		}
-	}
 
-	return nil
-
-}
-
-func (s *RedisStore) RemoveProfile(pid PidType) error {
-
-	p, err := s.Profile(pid)
-	if err != nil {
-		return err
-	}
-
-	rs := s.pdb.Command("DEL", possiblyKey(pid, ORDERING_TS))
-	if !rs.IsOK() {
-		return rs.Error()
-	}
-
-	rs = s.pdb.Command("DEL", maybeKey(pid, ORDERING_TS))
-	if !rs.IsOK() {
-		return rs.Error()
+		if err := s.indexEmail(pid, email); err != nil {
+			return err
+		}
 	}
 
-	rs = s.pdb.Command("DEL", profileKey(pid))
+	rs := s.pdb.Command("HMSET", hashArgs(profileKey(pid), values)...)
 	if !rs.IsOK() {
+		// Release the address reserved above, unless the profile already had it
+		if changingEmail && normaliseEmail(email) != normaliseEmail(oldEmail) {
+			if err := s.unindexEmail(pid, email); err != nil {
+				applog.Errorf("Could not release email of %s: %s", pid, err.Error())
+			}
+		}
 		return rs.Error()
 	}
 
-	rs = s.pdb.Command("ZRANGE", followingKey(pid), 0, MaxInt)
-	if !rs.IsOK() {
-		return rs.Error()
+	if changingEmail {
+		if err := s.changeEmail(pid, oldEmail, email); err != nil {
+			return err
+		}
 	}
 
-	vals := rs.ValuesAsStrings()
-	for _, val := range vals {
-		rs = s.pdb.Command("ZREM", followersKey(PidType(val)), pid)
+	if feedurl, exists := values["feedurl"]; exists && feedurl != "" {
+		// TODO: remove pid if feedurl is empty
+		rs := s.pdb.Command("SADD", FEED_DRIVEN_PROFILES, pid)
 		if !rs.IsOK() {
 			return rs.Error()
 		}
 	}
 
-	rs = s.pdb.Command("DEL", followingKey(pid))
-	if !rs.IsOK() {
-		return rs.Error()
-	}
-
-	rs = s.pdb.Command("SREM", FEED_DRIVEN_PROFILES, pid)
-	if !rs.IsOK() {
-		return rs.Error()
-	}
-
-	if p.ParentPid != "" {
-		rs = s.pdb.Command("SREM", feedsKey(p.ParentPid), pid)
-		if !rs.IsOK() {
-			return rs.Error()
+	if changingParent && parentpid != oldParent {
+		if oldParent != "" {
+			rs := s.pdb.Command("SREM", feedsKey(PidType(oldParent)), pid)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+		}
+		if parentpid != "" {
+			rs := s.pdb.Command("SADD", feedsKey(PidType(parentpid)), pid)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
 		}
 	}
 
-	rs = s.pdb.Command("ZREM", FLAGGED_PROFILES, pid)
-	if !rs.IsOK() {
-		// OK TO IGNORE
+	if indexedChange(values) {
+		if err := s.indexProfile(pid); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// Removes the profile and everything that refers to it. See DeleteProfile.
+func (s *RedisStore) RemoveProfile(pid PidType) error {
+	_, err := s.DeleteProfile(pid)
+	return err
+}
+
 func (s *RedisStore) FlagProfile(pid PidType) error {
 
 	rs := s.pdb.Command("ZINCRBY", FLAGGED_PROFILES, "1.0", pid)
@@ -522,95 +585,225 @@ func (s *RedisStore) FeedDrivenProfiles() ([]*Profile, error) {
 func (s *RedisStore) TimelineRange(pid PidType, status string, ts time.Time, before int, after int) ([]*FormattedItem, error) {
 
 	score := itemScore(ts)
+	timelineKey := timelineKey(pid, status)
 
-	var timelineKey string
-	if status == "p" {
-		timelineKey = possiblyKey(pid, "ts")
-	} else {
-		timelineKey = maybeKey(pid, "ts")
-	}
-
-	vals := make([]string, 0)
-	itemkeys := make([]string, 0)
+	members := make([]scoredMember, 0)
 
 	if after > 0 {
-		// log.Print("ZRANGEBYSCORE", " ", key, " ", score, " ", "+Inf", " ", "WITHSCORES", " ", "LIMIT", " ", 0, " ", after+1)
-		rs := s.tdb.Command("ZRANGEBYSCORE", timelineKey, score, "+Inf", "WITHSCORES", "LIMIT", 0, after)
-		if !rs.IsOK() {
-			return nil, rs.Error()
+		vals, err := s.scanTimeline(timelineKey, scoreRange{min: score, max: math.Inf(1)}, after, false)
+		if err != nil {
+			return nil, err
 		}
 
-		vals = rs.ValuesAsStrings()
-
-		itemkeys = make([]string, len(vals))
-		for i := 0; i < len(vals); i += 2 {
-			itemkeys[len(vals)-i-2] = vals[i]
-			itemkeys[len(vals)-i-1] = vals[i+1]
-
+		for i := len(vals) - 1; i >= 0; i-- {
+			members = append(members, vals[i])
 		}
 	}
 
 	// Don't include duplicate item
-	delim := ""
-	if len(vals) > 0 {
-		delim = "("
+	r := scoreRange{min: math.Inf(-1), max: score, maxExclusive: len(members) > 0}
+	vals, err := s.scanTimeline(timelineKey, r, before+1, true)
+	if err != nil {
+		return nil, err
+	}
+	members = append(members, vals...)
+
+	return s.formatTimelineItems(pid, members)
+}
+
+// Gets a page of pid's timeline, newest first, starting from the position
+// encoded in cursor. An empty cursor starts from the newest item.
+func (s *RedisStore) TimelinePage(pid PidType, status string, cursor string, count int) (*TimelineRange, error) {
+	members, next, prev, err := timelinePage(s, timelineKey(pid, status), cursor, count)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.formatTimelineItems(pid, members)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTimelineRange(pid, items, next, prev), nil
+}
+
+// Gets the items in pid's timeline scheduled in the window [tstart, tend),
+// earliest first. A limit of zero or less returns every item in the window.
+func (s *RedisStore) TimelineWindow(pid PidType, status string, tstart time.Time, tend time.Time, limit int) (*TimelineRange, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+
+	members, err := s.scanTimeline(timelineKey(pid, status), timelineWindow(tstart, tend), limit, false)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := s.formatTimelineItems(pid, members)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TimelineRange{
+		Pid:    string(pid),
+		Tstart: tstart,
+		Tend:   tend,
+		Items:  items,
+	}, nil
+}
+
+// Counts the items in pid's timeline scheduled in the window [tstart, tend)
+func (s *RedisStore) TimelineWindowCount(pid PidType, status string, tstart time.Time, tend time.Time) (int, error) {
+	min, max := timelineWindow(tstart, tend).args()
+
+	rs := s.tdb.Command("ZCOUNT", timelineKey(pid, status), min, max)
+	if !rs.IsOK() {
+		return 0, rs.Error()
 	}
-	formattedScore := fmt.Sprintf("%s%f", delim, score)
 
-	// log.Print("ZREVRANGEBYSCORE", " ", key, " ", formattedScore, " ", "-Inf", " ", "WITHSCORES", " ", "LIMIT", " ", 0, " ", before)
-	rs := s.tdb.Command("ZREVRANGEBYSCORE", timelineKey, formattedScore, "-Inf", "WITHSCORES", "LIMIT", 0, before+1)
+	return rs.ValueAsInt()
+}
+
+func (s *RedisStore) scanTimeline(timelineKey string, r scoreRange, count int, reverse bool) ([]scoredMember, error) {
+	return scanSortedSet(s.tdb, timelineKey, r, count, reverse)
+}
+
+// Reads up to count members of a sorted set with their scores, in the manner
+// of ZRANGEBYSCORE or ZREVRANGEBYSCORE. A negative count reads them all.
+func scanSortedSet(db *redis.Database, key string, r scoreRange, count int, reverse bool) ([]scoredMember, error) {
+	min, max := r.args()
+
+	var rs *redis.ResultSet
+	if reverse {
+		rs = db.Command("ZREVRANGEBYSCORE", key, max, min, "WITHSCORES", "LIMIT", 0, count)
+	} else {
+		rs = db.Command("ZRANGEBYSCORE", key, min, max, "WITHSCORES", "LIMIT", 0, count)
+	}
 	if !rs.IsOK() {
 		return nil, rs.Error()
 	}
 
-	vals = rs.ValuesAsStrings()
-	for i := 0; i < len(vals); i += 2 {
-		itemkeys = append(itemkeys, vals[i])
-		itemkeys = append(itemkeys, vals[i+1])
+	// 	get itemkey followed by score
+	vals := rs.ValuesAsStrings()
+	members := make([]scoredMember, 0, len(vals)/2)
+	for i := 0; i < len(vals)-1; i += 2 {
+		score, err := strconv.ParseFloat(vals[i+1], 64)
+		if err != nil {
+			applog.Errorf("Could not parse score from db as float: %s", err.Error())
+			continue
+		}
+		members = append(members, scoredMember{member: vals[i], score: score})
 	}
 
-	items := make([]*FormattedItem, 0)
+	return members, nil
+}
 
-	for ik := 0; ik < len(itemkeys); ik += 2 {
+// Loads and formats the items in a timeline, skipping any that no longer
+// exist. The items, their sources and the profiles they refer to are each
+// read in a single batch rather than item by item.
+func (s *RedisStore) formatTimelineItems(pid PidType, members []scoredMember) ([]*FormattedItem, error) {
+	items := make([]*FormattedItem, 0, len(members))
+	if len(members) == 0 {
+		return items, nil
+	}
 
-		key := itemkeys[ik]
-		score := itemkeys[ik+1]
+	keys := make([]interface{}, len(members))
+	for i, m := range members {
+		keys[i] = m.member
+	}
 
-		// if key[0] == EVENTED_ITEM_PREFIX {
-		// 	key = key[1:]
-		// }
+	rs := s.idb.Command("MGET", keys...)
+	if !rs.IsOK() {
+		return nil, rs.Error()
+	}
+	itemVals := rs.ValuesAsStrings()
 
-		rs = s.idb.Command("GET", key)
-		if !rs.IsOK() {
-			applog.Errorf("Could not get key %s from db: %s", key, rs.Error().Error())
+	sources := make([]string, len(members))
+	rs = s.tdb.Command("HMGET", append([]interface{}{sourcesKey(pid)}, keys...)...)
+	if !rs.IsOK() {
+		return nil, rs.Error()
+	}
+	copy(sources, rs.ValuesAsStrings())
+
+	fitems := make([]*FormattedItem, 0, len(members))
+	vias := make([]PidType, 0, len(members))
+	pids := make([]PidType, 0)
+	seen := make(map[PidType]bool)
+	addPid := func(p PidType) {
+		if !seen[p] {
+			seen[p] = true
+			pids = append(pids, p)
+		}
+	}
+
+	for i, m := range members {
+		if i >= len(itemVals) || itemVals[i] == "" {
+			applog.Errorf("Could not get key %s from db", m.member)
 			continue
 		}
 
-		item_infos := rs.ValuesAsStrings()
-		for _, item_info := range item_infos {
-			item := &Item{}
+		item := &Item{}
+		_ = json.Unmarshal([]byte(itemVals[i]), item)
 
-			_ = json.Unmarshal([]byte(item_info), item)
+		via := PidType("")
+		if source := PidType(sources[i]); isVia(source, item, pid) {
+			via = source
+			addPid(via)
+		}
+		addPid(item.Pid)
 
-			f, err := strconv.ParseFloat(score, 64)
-			if err != nil {
-				applog.Errorf("Could not parse score from db as float: %s", err.Error())
-				continue
-			}
+		fitems = append(fitems, newFormattedItem(item, int64(m.score)))
+		vias = append(vias, via)
+	}
 
-			ts := int64(f)
+	profiles, err := s.briefProfiles(pids)
+	if err != nil {
+		return nil, err
+	}
 
-			fitem, err := s.FormatItem(item, ts, pid)
-			if err != nil {
-				applog.Errorf("Could not format item: %s", err.Error())
-				continue
-			}
-			items = append(items, fitem)
+	for i, fitem := range fitems {
+		fitem.Author = profiles[fitem.Pid]
+		if vias[i] != "" {
+			fitem.Via = profiles[vias[i]]
 		}
+		items = append(items, fitem)
 	}
+
 	return items, nil
 }
 
+// Reads the brief profiles for several pids in one transaction
+func (s *RedisStore) briefProfiles(pids []PidType) (map[PidType]*BriefProfile, error) {
+	profiles := make(map[PidType]*BriefProfile, len(pids))
+	if len(pids) == 0 {
+		return profiles, nil
+	}
+
+	fields := briefProfileCodec.names()
+	rs := s.pdb.MultiCommand(func(mc *redis.MultiCommand) {
+		for _, pid := range pids {
+			args := []interface{}{profileKey(pid)}
+			for _, f := range fields {
+				args = append(args, f)
+			}
+			mc.Command("HMGET", args...)
+		}
+	})
+	if !rs.IsOK() {
+		return nil, rs.Error()
+	}
+
+	for i, pid := range pids {
+		p := &BriefProfile{Pid: pid}
+		if i < rs.ResultSetCount() {
+			briefProfileCodec.decodeValues(rs.ResultSetAt(i).ValuesAsStrings(), p)
+		}
+		profiles[pid] = p
+	}
+
+	return profiles, nil
+}
+
 // Gets an item as it appears in a timeline along with any associated event
 func (s *RedisStore) ItemInTimeline(item *Item, pid PidType, status string) ([]*FormattedItem, error) {
 	items := make([]*FormattedItem, 0)
@@ -652,9 +845,7 @@ func (s *RedisStore) FormatItem(item *Item, ts int64, pid PidType) (*FormattedIt
 	} else {
 		source = PidType(rs.ValueAsString())
 	}
-	fitem := &FormattedItem{Item: *item, Ts: ts}
-	fitem.Added = item.Added / 1000000000
-	fitem.Event = item.Event / 1000000000
+	fitem := newFormattedItem(item, ts)
 
 	aprofile, err := s.BriefProfile(item.Pid)
 	if err != nil {
@@ -662,7 +853,7 @@ func (s *RedisStore) FormatItem(item *Item, ts int64, pid PidType) (*FormattedIt
 	}
 	fitem.Author = aprofile
 
-	if source != PidType("") && source != item.Pid && source != pid {
+	if isVia(source, item, pid) {
 		sprofile, err := s.BriefProfile(source)
 		if err != nil {
 			return nil, err
@@ -711,13 +902,7 @@ func (s *RedisStore) ItemByKey(itemKey string) (*Item, error) {
 func (s *RedisStore) AddItem(pid PidType, ets time.Time, text string, link string, image string, itemid ItemIdType, media string, duration int) (ItemIdType, error) {
 
 	if itemid == "" {
-
-		hasher := md5.New()
-		io.WriteString(hasher, string(pid))
-		io.WriteString(hasher, text)
-		io.WriteString(hasher, link)
-		io.WriteString(hasher, ets.String())
-		itemid = ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
+		itemid = defaultItemId(pid, ets, text, link)
 	}
 
 	if exists, _ := s.ItemExists(itemid); exists {
@@ -754,7 +939,9 @@ func (s *RedisStore) AddItem(pid PidType, ets time.Time, text string, link strin
 		return "", rs.Error()
 	}
 
-	s.AddItemToFollowerTimelines(pid, scheduledTime, item)
+	if err := s.queueAddToFollowers(pid, scheduledTime, item); err != nil {
+		return "", err
+	}
 
 	if item.Link != "" && item.Image == "" {
 		rs := s.pdb.Command("SADD", ITEMS_NEEDING_IMAGES, itemid)
@@ -774,8 +961,13 @@ func (s *RedisStore) SaveItem(item *Item, lifetime int) (string, error) {
 
 	itemKey := ItemKey(item.Id)
 
+	rs := s.idb.Command("SADD", authoredKey(item.Pid), item.Id)
+	if !rs.IsOK() {
+		return "", rs.Error()
+	}
+
 	if lifetime > 0 {
-		rs := s.pdb.Command("EXPIRE", itemKey, lifetime)
+		rs := s.idb.Command("EXPIRE", itemKey, lifetime)
 		if !rs.IsOK() {
 			applog.Errorf("Could not set expiry for temporary item %s: %s", itemKey, rs.Error().Error())
 		}
@@ -788,8 +980,7 @@ func (s *RedisStore) SaveItem(item *Item, lifetime int) (string, error) {
 
 func (s *RedisStore) UpdateItem(item *Item) error {
 	if strings.Contains(item.Image, "/") {
-		applog.Debugf("Caching image from %s", item.Image)
-		item.Image, _ = CacheImage(item.Image, s.imgpath)
+		s.cacheItemImage(item)
 	}
 
 	itemKey := ItemKey(item.Id)
@@ -807,17 +998,181 @@ func (s *RedisStore) UpdateItem(item *Item) error {
 
 }
 
-func (s *RedisStore) ItemExists(id ItemIdType) (bool, error) {
-	rs := s.idb.Command("EXISTS", ItemKey(id))
-	if !rs.IsOK() {
-		return false, rs.Error()
+// Saves changes to an item. When the event time changes the item is moved to
+// its new time in every timeline it appears in, except that entries made by
+// promoting an item that is no longer an event keep their promotion time.
+func (s *RedisStore) EditItem(item *Item) error {
+	old, err := s.Item(item.Id)
+	if err != nil {
+		return err
 	}
 
-	val, err := rs.ValueAsBool()
-	return val, err
-}
+	// The author and creation time can't be edited
+	item.Pid = old.Pid
+	item.Added = old.Added
 
-func (s *RedisStore) DeleteMaybeItems(pid PidType) error {
+	if err := s.UpdateItem(item); err != nil {
+		return err
+	}
+
+	if item.Event == old.Event {
+		return nil
+	}
+
+	pids, err := s.itemTimelinePids(old)
+	if err != nil {
+		return err
+	}
+
+	itemKey := ItemKey(item.Id)
+	scheduledTime := item.DefaultScheduledTime()
+
+	for _, pid := range pids {
+		if pid != item.Pid && !item.IsEvent() {
+			continue
+		}
+
+		if err := s.rescheduleInTimeline(maybeKey(pid, ORDERING_TS), scheduledTime, itemKey); err != nil {
+			return err
+		}
+
+		if err := s.queueRescheduleInFollowers(pid, item.Id, scheduledTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Removes an item from every timeline it appears in and deletes it. Removal
+// from followers' timelines is queued for the fan-out workers.
+func (s *RedisStore) DeleteItem(id ItemIdType) error {
+	item, err := s.Item(id)
+	if err != nil {
+		return err
+	}
+
+	pids, err := s.itemTimelinePids(item)
+	if err != nil {
+		return err
+	}
+
+	itemKey := ItemKey(id)
+
+	for _, pid := range pids {
+		rs := s.tdb.Command("ZREM", maybeKey(pid, ORDERING_TS), itemKey)
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+
+		if err := s.queueRemoveFromFollowers(pid, id); err != nil {
+			return err
+		}
+	}
+
+	rs := s.tdb.Command("DEL", promotersKey(itemKey))
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	rs = s.pdb.Command("SREM", ITEMS_NEEDING_IMAGES, id)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	rs = s.idb.Command("SREM", authoredKey(item.Pid), id)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	rs = s.idb.Command("DEL", itemKey)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// Lists the profiles whose maybe timeline may contain the item: its author
+// and everyone who promoted it
+func (s *RedisStore) itemTimelinePids(item *Item) ([]PidType, error) {
+	rs := s.tdb.Command("SMEMBERS", promotersKey(item.Key()))
+	if !rs.IsOK() {
+		return nil, rs.Error()
+	}
+
+	pids := []PidType{item.Pid}
+	for _, pid := range rs.ValuesAsStrings() {
+		if PidType(pid) != item.Pid {
+			pids = append(pids, PidType(pid))
+		}
+	}
+
+	return pids, nil
+}
+
+// Records the promoters of every item from the maybe timelines, returning the
+// number of promotions indexed. Only needed for items promoted before the
+// promoters of an item were recorded.
+func (s *RedisStore) RebuildPromotersIndex() (int, error) {
+	n := 0
+	suffix := maybeKey("", ORDERING_TS)
+
+	err := scanKeys(s.tdb, maybeKey("*", ORDERING_TS), func(keys []string) error {
+		for _, key := range keys {
+			pid := PidType(strings.TrimSuffix(key, suffix))
+
+			rs := s.tdb.Command("ZRANGE", key, 0, -1)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+
+			for _, itemKey := range rs.ValuesAsStrings() {
+				item, err := s.ItemByKey(itemKey)
+				if err != nil {
+					if isKeyNotFound(err) {
+						continue
+					}
+					return err
+				}
+				if item.Pid == pid {
+					continue
+				}
+
+				rs := s.tdb.Command("SADD", promotersKey(itemKey), pid)
+				if !rs.IsOK() {
+					return rs.Error()
+				}
+				n++
+			}
+		}
+		return nil
+	})
+
+	return n, err
+}
+
+func (s *RedisStore) rescheduleInTimeline(timelineKey string, ts int64, itemKey string) error {
+	rs := rescheduleInTimelineScript.run(s.tdb, []string{timelineKey}, ts, itemKey)
+	if !rs.IsOK() {
+		applog.Errorf("Could not reschedule item %s in timeline %s: %s", itemKey, timelineKey, rs.Error().Error())
+		return rs.Error()
+	}
+
+	return nil
+}
+
+func (s *RedisStore) ItemExists(id ItemIdType) (bool, error) {
+	rs := s.idb.Command("EXISTS", ItemKey(id))
+	if !rs.IsOK() {
+		return false, rs.Error()
+	}
+
+	val, err := rs.ValueAsBool()
+	return val, err
+}
+
+func (s *RedisStore) DeleteMaybeItems(pid PidType) error {
 	rs := s.tdb.Command("DEL", maybeKey(pid, ORDERING_TS))
 	if !rs.IsOK() {
 		return rs.Error()
@@ -869,31 +1224,7 @@ func (s *RedisStore) Follow(pid PidType, followpid PidType) error {
 	}
 
 	// Copy all of followpid's items into pid's timeline
-	// Slow but accurate method
-
-	sourceTimelineKey := maybeKey(followpid, ORDERING_TS)
-	rs = s.tdb.Command("ZRANGEBYSCORE", sourceTimelineKey, 0, "+Inf", "WITHSCORES")
-	if !rs.IsOK() {
-		return rs.Error()
-	}
-
-	// 	get itemkey followed by score
-	vals := rs.ValuesAsStrings()
-	for ik := 0; ik < len(vals); ik += 2 {
-
-		itemKey := vals[ik]
-		score := vals[ik+1]
-
-		f, err := strconv.ParseFloat(score, 64)
-		if err != nil {
-			applog.Errorf("Could not parse score from db as float: %s", err.Error())
-			continue
-		}
-
-		ts := int64(f)
-		s.AddItemToTimeline(pid, followpid, ts, itemKey)
-	}
-	return nil
+	return s.queueFanout(&fanoutJob{Op: fanoutFollow, Source: followpid, Pid: pid})
 }
 
 // Make pid stop following followpid
@@ -910,21 +1241,7 @@ func (s *RedisStore) Unfollow(pid PidType, followpid PidType) error {
 	}
 
 	// Remove all of followpid's items from pid's timeline
-	// Slow but accurate method
-
-	sourceTimelineKey := maybeKey(followpid, ORDERING_TS)
-	applog.Debugf("ZRANGEBYSCORE %s 0 +Inf", sourceTimelineKey)
-	rs = s.tdb.Command("ZRANGEBYSCORE", sourceTimelineKey, 0, "+Inf")
-	if !rs.IsOK() {
-		return rs.Error()
-	}
-
-	// 	get itemkey
-	for _, itemKey := range rs.ValuesAsStrings() {
-		applog.Debugf("Found itemkey %s", itemKey)
-		s.RemoveItemFromTimeline(pid, followpid, itemKey)
-	}
-	return nil
+	return s.queueFanout(&fanoutJob{Op: fanoutUnfollow, Source: followpid, Pid: pid})
 }
 
 func (s *RedisStore) Promote(pid PidType, id ItemIdType) error {
@@ -942,7 +1259,7 @@ func (s *RedisStore) Promote(pid PidType, id ItemIdType) error {
 	// }
 
 	// Ensure the item is persisted (in case it's a temporary search item)
-	rs := s.tdb.Command("PERSIST", itemKey)
+	rs := s.idb.Command("PERSIST", itemKey)
 	if !rs.IsOK() {
 		return rs.Error()
 	}
@@ -964,6 +1281,13 @@ func (s *RedisStore) Promote(pid PidType, id ItemIdType) error {
 		return rs.Error()
 	}
 
+	if pid != item.Pid {
+		rs = s.tdb.Command("SADD", promotersKey(itemKey), pid)
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+	}
+
 	// if item.Event > 0 {
 	// 	eventedItemKey := EventedItemKey(id)
 	// 	rs = s.tdb.Command("ZADD", maybe_key, item.Event, eventedItemKey)
@@ -972,9 +1296,7 @@ func (s *RedisStore) Promote(pid PidType, id ItemIdType) error {
 	// 	}
 	// }
 
-	s.AddItemToFollowerTimelines(pid, scheduledTime, item)
-
-	return nil
+	return s.queueAddToFollowers(pid, scheduledTime, item)
 
 }
 
@@ -990,6 +1312,11 @@ func (s *RedisStore) Demote(pid PidType, id ItemIdType) error {
 		return rs.Error()
 	}
 
+	rs = s.tdb.Command("SREM", promotersKey(itemKey), pid)
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
 	// rs = s.tdb.Command("ZREM", maybe_key, eventedItemKey)
 	// if !rs.IsOK() {
 	// 	return rs.Error()
@@ -1016,9 +1343,7 @@ func (s *RedisStore) Demote(pid PidType, id ItemIdType) error {
 	// 		return rs.Error()
 	// 	}
 	// }
-	s.RemoveItemFromFollowerTimelines(pid, itemKey)
-
-	return nil
+	return s.queueRemoveFromFollowers(pid, id)
 }
 
 func (s *RedisStore) Followers(pid PidType, count int, start int) ([]*FollowingProfile, error) {
@@ -1086,66 +1411,6 @@ func (s *RedisStore) Follows(pid PidType, follower PidType) (bool, error) {
 	return true, nil
 }
 
-func (s *RedisStore) VerifyPassword(pid PidType, password string) (bool, error) {
-	rs := s.pdb.Command("HGET", profileKey(pid), "pwdhash")
-	if !rs.IsOK() {
-		return false, rs.Error()
-	}
-
-	pwdhash := rs.ValueAsString()
-
-	err := bcrypt.CompareHashAndPassword([]byte(pwdhash), []byte(password))
-	if err != nil {
-		return false, err
-	}
-
-	return true, nil
-}
-
-func (s *RedisStore) SessionId(pid PidType) (int64, error) {
-	sessionId := rand.Int63()
-	rs := s.sdb.Command("SET", sessionKey(sessionId), pid)
-	if !rs.IsOK() {
-		return 0, rs.Error()
-	}
-
-	return sessionId, nil
-}
-
-func (s *RedisStore) ValidSession(pid PidType, sessionId int64) (bool, error) {
-	rs := s.sdb.Command("GET", sessionKey(sessionId))
-	if !rs.IsOK() {
-		return false, rs.Error()
-	}
-
-	return (PidType(rs.ValueAsString()) == pid), nil
-
-}
-
-func (s *RedisStore) SetOauthSessionData(key string, data string) error {
-
-	rs := s.sdb.Command("SET", oauthSessionKey(key), data)
-	if !rs.IsOK() {
-		return rs.Error()
-	}
-	rs = s.pdb.Command("EXPIRE", oauthSessionKey(key), 600)
-	if !rs.IsOK() {
-		return rs.Error()
-	}
-
-	return nil
-}
-
-func (s *RedisStore) GetOauthSessionData(key string) (string, error) {
-	rs := s.sdb.Command("GET", oauthSessionKey(key))
-	if !rs.IsOK() {
-		return "", rs.Error()
-	}
-
-	return rs.ValueAsString(), nil
-
-}
-
 func (s *RedisStore) Feeds(pid PidType) ([]*Profile, error) {
 	rs := s.pdb.Command("SMEMBERS", feedsKey(pid))
 	if !rs.IsOK() {
@@ -1169,66 +1434,26 @@ func (s *RedisStore) Feeds(pid PidType) ([]*Profile, error) {
 
 }
 
+// Removes up to max items from the set needing images and returns them. The
+// caller is responsible for the items, which won't be returned again.
 func (s *RedisStore) GrabItemsNeedingImages(max int) ([]*Item, error) {
 	items := make([]*Item, 0)
 
-	if keyExists(s.pdb, ITEMS_NEEDING_IMAGES) {
-
-		for i := 0; i < max; i++ {
-
-			rs := s.pdb.Command("SRANDMEMBER", ITEMS_NEEDING_IMAGES)
-			if !rs.IsOK() {
-				return items, rs.Error()
-			}
-
-			itemid := ItemIdType(rs.ValueAsString())
-
-			s.pdb.Command("SREM", ITEMS_NEEDING_IMAGES, itemid)
-			item, err := s.Item(itemid)
-			if err == nil {
-				items = append(items, item)
+	for i := 0; i < max; i++ {
+		rs := s.pdb.Command("SPOP", ITEMS_NEEDING_IMAGES)
+		if !rs.IsOK() {
+			if isKeyNotFound(rs.Error()) {
+				break
 			}
+			return items, rs.Error()
 		}
-	}
-	return items, nil
-}
-
-func (s *RedisStore) FindProfilesBySubstring(srch string) ([]*Profile, error) {
 
-	profiles := make([]*Profile, 0)
-
-	// Full wildcard is an exception
-	if srch == "*" {
-		srch = ""
-	} else {
-		// Bail if the search contains non alphanumerics or @
-		allgood, _ := regexp.MatchString("^[a-zA-Z0-9@]+$", srch)
-		if !allgood {
-
-			applog.Errorf("Invalid search string supplied: %s", srch)
-			return profiles, nil
-		}
-	}
-
-	searchKey := fmt.Sprintf("*%s*:info", srch)
-	rs := s.pdb.Command("KEYS", searchKey)
-	if !rs.IsOK() {
-		return nil, rs.Error()
-	}
-
-	vals := rs.ValuesAsStrings()
-
-	for _, key := range vals {
-		profile, err := s.Profile(pidFromKey(key))
-		if err != nil {
-			// TODO: log
-		} else {
-			profiles = append(profiles, profile)
+		item, err := s.Item(ItemIdType(rs.ValueAsString()))
+		if err == nil {
+			items = append(items, item)
 		}
 	}
-
-	return profiles, nil
-
+	return items, nil
 }
 
 func dumpKeys(db *redis.Database, pattern string) {
@@ -1243,6 +1468,10 @@ func dumpKeys(db *redis.Database, pattern string) {
 	}
 }
 
+func isKeyNotFound(err error) bool {
+	return err != nil && (err == ErrKeyNotFound || err.Error() == "redis: key not found")
+}
+
 func keyExists(db *redis.Database, key string) bool {
 	rs := db.Command("EXISTS", key)
 	if !rs.IsOK() {
@@ -1254,6 +1483,69 @@ func keyExists(db *redis.Database, key string) bool {
 	return val
 }
 
+// Calls f with each batch of keys matching pattern. Keys are found with SCAN
+// so the server isn't blocked, which means a key may be passed more than once
+// and keys added during the scan may be missed.
+func scanKeys(db *redis.Database, pattern string, f func(keys []string) error) error {
+	cursor := "0"
+	for {
+		rs := db.Command("SCAN", cursor, "MATCH", pattern, "COUNT", scanBatchSize)
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+
+		// The reply is the next cursor followed by a list of keys
+		cursor = rs.ValueAt(0).String()
+		if err := f(rs.ResultSetAt(0).ValuesAsStrings()); err != nil {
+			return err
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// Calls f with the pids of every profile a batch at a time. Other keys that
+// end in ":info", such as the suggested profiles for a location called
+// "info", are skipped.
+func scanProfiles(db *redis.Database, f func(pids []PidType) error) error {
+	return scanKeys(db, string(profileKey("*")), func(keys []string) error {
+		pids := make([]PidType, 0, len(keys))
+		for _, key := range keys {
+			rs := db.Command("TYPE", key)
+			if !rs.IsOK() {
+				return rs.Error()
+			}
+			if rs.ValueAsString() == "hash" {
+				pids = append(pids, pidFromKey(key))
+			}
+		}
+		return f(pids)
+	})
+}
+
+// Calls f with the members of a set a batch at a time using SSCAN. Members
+// added or removed during the scan may or may not be seen.
+func scanSet(db *redis.Database, key string, f func(members []string) error) error {
+	cursor := "0"
+	for {
+		rs := db.Command("SSCAN", key, cursor, "COUNT", scanBatchSize)
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+
+		cursor = rs.ValueAt(0).String()
+		if err := f(rs.ResultSetAt(0).ValuesAsStrings()); err != nil {
+			return err
+		}
+
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
 func (s *RedisStore) AddItemToFollowerTimelines(pid PidType, scheduledTime int64, item *Item) error {
 
 	rs := s.pdb.Command("ZRANGE", followersKey(pid), 0, MaxInt)
@@ -1279,27 +1571,11 @@ func (s *RedisStore) AddItemToTimeline(pid PidType, source PidType, ts int64, it
 	applog.Debugf("Adding item %s to timeline for %s with source %s", itemKey, pid, source)
 	timelineKey := possiblyKey(pid, ORDERING_TS)
 
-	rs := s.tdb.Command("ZSCORE", timelineKey, itemKey)
+	// Add the item and remember its source in one step
+	rs := addToTimelineScript.run(s.tdb, []string{timelineKey, sourcesKey(pid)}, ts, itemKey, source)
 	if !rs.IsOK() {
-		if rs.Error().Error() != "redis: key not found" {
-			applog.Errorf("Could not get score for %s in %s: %s", itemKey, timelineKey, rs.Error().Error())
-			return rs.Error()
-		}
-
-		rs = s.tdb.Command("ZADD", timelineKey, ts, itemKey)
-		if !rs.IsOK() {
-			applog.Errorf("Could not add item %s to timeline %s: %s", itemKey, timelineKey, rs.Error().Error())
-			return rs.Error()
-		}
-
-		// Remember the source of the item
-		sourcesKey := sourcesKey(pid)
-		rs = s.tdb.Command("HSET", sourcesKey, itemKey, source)
-		if !rs.IsOK() {
-			applog.Errorf("Could not set source for %s in %s: %s", itemKey, sourcesKey, rs.Error().Error())
-			return rs.Error()
-		}
-
+		applog.Errorf("Could not add item %s to timeline %s: %s", itemKey, timelineKey, rs.Error().Error())
+		return rs.Error()
 	}
 
 	return nil
@@ -1325,35 +1601,35 @@ func (s *RedisStore) RemoveItemFromFollowerTimelines(pid PidType, itemKey string
 }
 
 func (s *RedisStore) RemoveItemFromTimeline(pid PidType, source PidType, itemKey string) error {
-	applog.Debugf("Removing item %s from timeline for %s", itemKey, pid)
-	sourcesKey := sourcesKey(pid)
-
-	// Only remove if source is same as the source recorded for this timeline
-	rs := s.tdb.Command("HGET", sourcesKey, itemKey)
-	if !rs.IsOK() {
-		applog.Errorf("Could not get a source for item %s for pid %s: %s", itemKey, pid, rs.Error().Error())
-		return rs.Error()
-	}
-
-	if source != PidType(rs.ValueAsString()) {
-		// Don't remove the item because it came from a different source
-		return nil
-	}
+	_, err := s.removeFromTimeline(pid, source, itemKey)
+	return err
+}
 
+// Removes an item from pid's timeline if it came from source, reporting
+// whether it was removed
+func (s *RedisStore) removeFromTimeline(pid PidType, source PidType, itemKey string) (bool, error) {
+	applog.Debugf("Removing item %s from timeline for %s", itemKey, pid)
 	timelineKey := possiblyKey(pid, ORDERING_TS)
 
-	rs = s.tdb.Command("ZREM", timelineKey, itemKey)
-	if !rs.IsOK() {
-		return rs.Error()
-	}
-
-	rs = s.tdb.Command("HDEL", sourcesKey, itemKey)
+	// Only remove if source is same as the source recorded for this timeline
+	rs := removeFromTimelineScript.run(s.tdb, []string{timelineKey, sourcesKey(pid)}, itemKey, source)
 	if !rs.IsOK() {
-		return rs.Error()
+		applog.Errorf("Could not remove item %s from timeline %s: %s", itemKey, timelineKey, rs.Error().Error())
+		return false, rs.Error()
 	}
 
-	return nil
+	removed, _ := rs.ValueAsBool()
+	return removed, nil
+}
 
+// Derives a stable item id from the item's content
+func defaultItemId(pid PidType, ets time.Time, text string, link string) ItemIdType {
+	hasher := md5.New()
+	io.WriteString(hasher, string(pid))
+	io.WriteString(hasher, text)
+	io.WriteString(hasher, link)
+	io.WriteString(hasher, ets.String())
+	return ItemIdType(fmt.Sprintf("%x", hasher.Sum(nil)))
 }
 
 // Fakes some nano second precision for events for unique ordering
@@ -1370,40 +1646,3 @@ func FakeEventPrecision(ets time.Time) int64 {
 
 	return etsnano
 }
-
-func CacheImage(url string, imgpath string) (string, error) {
-	imgResp, err := http.Get(url)
-	if err != nil {
-		applog.Errorf("Error fetching image from %s: %s", url, err.Error())
-		return url, err
-	}
-
-	defer imgResp.Body.Close()
-	img, _, err := image.Decode(imgResp.Body)
-	if err != nil {
-		applog.Errorf("Error decoding image from %s: %s", url, err.Error())
-		return url, err
-	}
-
-	imgOut := salience.Crop(img, 460, 160)
-
-	hasher := md5.New()
-	io.WriteString(hasher, url)
-	id := fmt.Sprintf("%x", hasher.Sum(nil))
-
-	bestImageFilename := fmt.Sprintf("%s.png", id)
-
-	foutName := path.Join(imgpath, bestImageFilename)
-
-	fout, err := os.OpenFile(foutName, os.O_CREATE|os.O_WRONLY, 0666)
-	if err != nil {
-		return url, err
-	}
-
-	if err = png.Encode(fout, imgOut); err != nil {
-		return url, err
-	}
-
-	return bestImageFilename, nil
-
-}
@@ -0,0 +1,485 @@
+package datastore
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// The store tests run against MemoryStore and RedisStore. RedisStore is
+// tested against the redis server at DATASTORE_TEST_REDIS, or at
+// defaultTestRedisAddr if that isn't set, and the tests fail if it can't be
+// reached. Databases 12 to 15 on that server are flushed by the tests. Run
+// the tests with -short to test MemoryStore alone.
+const (
+	testRedisEnv         = "DATASTORE_TEST_REDIS"
+	defaultTestRedisAddr = "127.0.0.1:6379"
+)
+
+func testConfig(addr string) Config {
+	config := DefaultConfig
+	config.Profile = RedisConfig{Address: addr, Database: 12, PoolSize: 10}
+	config.Timeline = RedisConfig{Address: addr, Database: 13, PoolSize: 10}
+	config.Item = RedisConfig{Address: addr, Database: 14, PoolSize: 10}
+	config.Session = RedisConfig{Address: addr, Database: 15, PoolSize: 10}
+	config.Passwords.Cost = 4
+	return config
+}
+
+// Runs test against a new, empty instance of each store
+func forEachStore(t *testing.T, test func(t *testing.T, s Store)) {
+	t.Run("memory", func(t *testing.T) {
+		s := NewMemoryStore(testConfig(""), nil)
+		defer s.Close()
+		test(t, s)
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		s := newTestRedisStore(t)
+		defer s.Close()
+		test(t, s)
+	})
+}
+
+// The config of a RedisStore for testing. Skips the test in short mode.
+func testRedisConfig(t testing.TB) Config {
+	if testing.Short() {
+		t.Skip("not testing redis in short mode")
+	}
+
+	addr := os.Getenv(testRedisEnv)
+	if addr == "" {
+		addr = defaultTestRedisAddr
+	}
+	return testConfig(addr)
+}
+
+func newTestRedisStore(t testing.TB) *RedisStore {
+	return newTestRedisStoreFrom(t, testRedisConfig(t))
+}
+
+func newTestRedisStoreFrom(t testing.TB, config Config) *RedisStore {
+	// Flush before connecting the store, so it never starts up on what an
+	// earlier test left behind
+	flushTestDatabases(t, config)
+
+	s, err := NewRedisStore(config, nil)
+	if err != nil {
+		t.Fatalf("NewRedisStore: %s", err)
+	}
+
+	return s
+}
+
+func flushTestDatabases(t testing.TB, config Config) {
+	for name, c := range map[string]RedisConfig{
+		DB_PROFILE:  config.Profile,
+		DB_TIMELINE: config.Timeline,
+		DB_ITEM:     config.Item,
+		DB_SESSION:  config.Session,
+	} {
+		db, err := connectDatabase(name, c)
+		if err != nil {
+			t.Fatalf("connectDatabase: %s", err)
+		}
+		rs := db.Command("FLUSHDB")
+		db.Close()
+		if !rs.IsOK() {
+			t.Fatalf("FLUSHDB: %s", rs.Error())
+		}
+	}
+}
+
+func addTestProfile(t *testing.T, s Store, pid PidType) {
+	if err := s.AddProfile(pid, "secret", string(pid), "", "", "", "", "", "", "", "", "", ""); err != nil {
+		t.Fatalf("AddProfile(%s): %s", pid, err)
+	}
+}
+
+func addTestItem(t *testing.T, s Store, pid PidType, text string) ItemIdType {
+	id, err := s.AddItem(pid, time.Time{}, text, "", "", "", "text", 0)
+	if err != nil {
+		t.Fatalf("AddItem: %s", err)
+	}
+	if err := s.WaitForFanout(id, 5*time.Second); err != nil {
+		t.Fatalf("WaitForFanout(%s): %s", id, err)
+	}
+	return id
+}
+
+func timelineIds(t *testing.T, s Store, pid PidType, status string) []ItemIdType {
+	items, err := s.TimelineRange(pid, status, time.Now().Add(time.Hour), 100, 0)
+	if err != nil {
+		t.Fatalf("TimelineRange(%s, %s): %s", pid, status, err)
+	}
+
+	ids := make([]ItemIdType, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.Id)
+	}
+	return ids
+}
+
+func sameIds(a []ItemIdType, b ...ItemIdType) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProfiles(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+
+		if exists, err := s.ProfileExists("alice"); err != nil || !exists {
+			t.Fatalf("ProfileExists(alice) = %v, %v", exists, err)
+		}
+		if exists, err := s.ProfileExists("nobody"); err != nil || exists {
+			t.Fatalf("ProfileExists(nobody) = %v, %v", exists, err)
+		}
+
+		if err := s.UpdateProfile("alice", map[string]string{"name": "Alice", "bio": "Hello"}); err != nil {
+			t.Fatalf("UpdateProfile: %s", err)
+		}
+
+		p, err := s.Profile("alice")
+		if err != nil {
+			t.Fatalf("Profile: %s", err)
+		}
+		if p.Pid != "alice" || p.Name != "Alice" || p.Bio != "Hello" || p.Joined == 0 {
+			t.Errorf("Profile = %+v", p)
+		}
+		if len(p.PasswordHash) != 0 {
+			t.Errorf("Profile includes the password hash")
+		}
+		if ok, err := s.VerifyPassword("alice", "secret"); err != nil || !ok {
+			t.Errorf("VerifyPassword = %v, %v", ok, err)
+		}
+
+		b, err := s.BriefProfile("alice")
+		if err != nil {
+			t.Fatalf("BriefProfile: %s", err)
+		}
+		if b.Pid != "alice" || b.Name != "Alice" {
+			t.Errorf("BriefProfile = %+v", b)
+		}
+
+		if err := s.UpdateProfile("alice", map[string]string{"joined": "1"}); err == nil {
+			t.Errorf("UpdateProfile changed a read-only field")
+		}
+	})
+}
+
+func feedPids(t *testing.T, s Store, pid PidType) []PidType {
+	feeds, err := s.Feeds(pid)
+	if err != nil {
+		t.Fatalf("Feeds(%s): %s", pid, err)
+	}
+
+	pids := make([]PidType, 0, len(feeds))
+	for _, p := range feeds {
+		pids = append(pids, p.Pid)
+	}
+	return pids
+}
+
+func TestChangeParent(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		addTestProfile(t, s, "bob")
+		if err := s.AddProfile("feed", "secret", "feed", "", "", "", "alice", "", "", "", "", "", ""); err != nil {
+			t.Fatalf("AddProfile: %s", err)
+		}
+
+		if err := s.UpdateProfile("feed", map[string]string{"parentpid": "bob"}); err != nil {
+			t.Fatalf("UpdateProfile: %s", err)
+		}
+		if feeds := feedPids(t, s, "alice"); len(feeds) != 0 {
+			t.Errorf("alice's feeds = %v, want none", feeds)
+		}
+		if feeds := feedPids(t, s, "bob"); len(feeds) != 1 || feeds[0] != "feed" {
+			t.Errorf("bob's feeds = %v, want feed", feeds)
+		}
+
+		if err := s.UpdateProfile("feed", map[string]string{"parentpid": ""}); err != nil {
+			t.Fatalf("UpdateProfile: %s", err)
+		}
+		if feeds := feedPids(t, s, "bob"); len(feeds) != 0 {
+			t.Errorf("bob's feeds = %v, want none", feeds)
+		}
+	})
+}
+
+func TestFollowTimelines(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		addTestProfile(t, s, "bob")
+
+		first := addTestItem(t, s, "alice", "first")
+
+		if err := s.Follow("bob", "alice"); err != nil {
+			t.Fatalf("Follow: %s", err)
+		}
+		second := addTestItem(t, s, "alice", "second")
+
+		if follows, err := s.Follows("alice", "bob"); err != nil || !follows {
+			t.Fatalf("Follows(alice, bob) = %v, %v", follows, err)
+		}
+
+		// Following copies the earlier item, the later one is fanned out
+		if ids := timelineIds(t, s, "bob", "p"); !sameIds(ids, second, first) {
+			t.Errorf("bob's possibly timeline = %v, want %v %v", ids, second, first)
+		}
+		if ids := timelineIds(t, s, "alice", "m"); !sameIds(ids, second, first) {
+			t.Errorf("alice's maybe timeline = %v, want %v %v", ids, second, first)
+		}
+
+		p, err := s.Profile("alice")
+		if err != nil {
+			t.Fatalf("Profile: %s", err)
+		}
+		if p.MaybeCount != 2 || p.FollowerCount != 1 {
+			t.Errorf("alice has %d maybe items and %d followers, want 2 and 1", p.MaybeCount, p.FollowerCount)
+		}
+
+		if err := s.Demote("alice", first); err != nil {
+			t.Fatalf("Demote: %s", err)
+		}
+		if err := s.WaitForFanout(first, 5*time.Second); err != nil {
+			t.Fatalf("WaitForFanout: %s", err)
+		}
+		if ids := timelineIds(t, s, "bob", "p"); !sameIds(ids, second) {
+			t.Errorf("bob's possibly timeline after demotion = %v, want %v", ids, second)
+		}
+
+		if err := s.Unfollow("bob", "alice"); err != nil {
+			t.Fatalf("Unfollow: %s", err)
+		}
+		// The unfollow is applied before any later change from alice
+		third := addTestItem(t, s, "alice", "third")
+		if ids := timelineIds(t, s, "bob", "p"); len(ids) != 0 {
+			t.Errorf("bob's possibly timeline after unfollowing = %v, want none", ids)
+		}
+		if ids := timelineIds(t, s, "alice", "m"); !sameIds(ids, third, second) {
+			t.Errorf("alice's maybe timeline = %v, want %v %v", ids, third, second)
+		}
+	})
+}
+
+func TestPromote(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		addTestProfile(t, s, "bob")
+		addTestProfile(t, s, "carol")
+
+		if err := s.Follow("carol", "bob"); err != nil {
+			t.Fatalf("Follow: %s", err)
+		}
+
+		id := addTestItem(t, s, "alice", "hello")
+		if err := s.Promote("bob", id); err != nil {
+			t.Fatalf("Promote: %s", err)
+		}
+		if err := s.WaitForFanout(id, 5*time.Second); err != nil {
+			t.Fatalf("WaitForFanout: %s", err)
+		}
+
+		if ids := timelineIds(t, s, "bob", "m"); !sameIds(ids, id) {
+			t.Errorf("bob's maybe timeline = %v, want %v", ids, id)
+		}
+
+		items, err := s.TimelineRange("carol", "p", time.Now().Add(time.Hour), 10, 0)
+		if err != nil {
+			t.Fatalf("TimelineRange: %s", err)
+		}
+		if len(items) != 1 || items[0].Id != id {
+			t.Fatalf("carol's possibly timeline = %v, want %v", items, id)
+		}
+		if items[0].Author == nil || items[0].Author.Pid != "alice" {
+			t.Errorf("item author = %+v, want alice", items[0].Author)
+		}
+		if items[0].Via == nil || items[0].Via.Pid != "bob" {
+			t.Errorf("item via = %+v, want bob", items[0].Via)
+		}
+	})
+}
+
+func TestDeleteMaybeItems(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		addTestItem(t, s, "alice", "hello")
+
+		if err := s.DeleteMaybeItems("alice"); err != nil {
+			t.Fatalf("DeleteMaybeItems: %s", err)
+		}
+		if ids := timelineIds(t, s, "alice", "m"); len(ids) != 0 {
+			t.Errorf("alice's maybe timeline = %v, want none", ids)
+		}
+	})
+}
+
+func TestTemporaryItems(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+
+		kept := &Item{Id: "kept", Pid: "alice", Text: "kept", Added: time.Now().UnixNano()}
+		lost := &Item{Id: "lost", Pid: "alice", Text: "lost", Added: time.Now().UnixNano()}
+		for _, item := range []*Item{kept, lost} {
+			if _, err := s.SaveItem(item, 1); err != nil {
+				t.Fatalf("SaveItem(%s): %s", item.Id, err)
+			}
+		}
+
+		// Promoting a temporary item keeps it
+		if err := s.Promote("alice", kept.Id); err != nil {
+			t.Fatalf("Promote: %s", err)
+		}
+
+		time.Sleep(1500 * time.Millisecond)
+
+		if exists, err := s.ItemExists(kept.Id); err != nil || !exists {
+			t.Errorf("ItemExists(kept) = %v, %v", exists, err)
+		}
+		if exists, err := s.ItemExists(lost.Id); err != nil || exists {
+			t.Errorf("ItemExists(lost) = %v, %v", exists, err)
+		}
+	})
+}
+
+func TestProfileTimelineCounts(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		addTestProfile(t, s, "bob")
+
+		if err := s.Follow("bob", "alice"); err != nil {
+			t.Fatalf("Follow: %s", err)
+		}
+		addTestItem(t, s, "alice", "first")
+		addTestItem(t, s, "alice", "second")
+
+		p, err := s.Profile("bob")
+		if err != nil {
+			t.Fatalf("Profile: %s", err)
+		}
+		if p.PossiblyCount != 2 || p.MaybeCount != 0 || p.FollowingCount != 1 {
+			t.Errorf("bob has %d possibly and %d maybe items and follows %d, want 2, 0 and 1", p.PossiblyCount, p.MaybeCount, p.FollowingCount)
+		}
+	})
+}
+
+// Scores are held as floats, so nanosecond times lose their last few digits
+func sameScore(a, b int64) bool {
+	d := a - b
+	return d > -int64(time.Microsecond) && d < int64(time.Microsecond)
+}
+
+func TestEditItemPromoters(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		addTestProfile(t, s, "bob")
+
+		id := addTestItem(t, s, "alice", "hello")
+		if err := s.Promote("bob", id); err != nil {
+			t.Fatalf("Promote: %s", err)
+		}
+		if err := s.WaitForFanout(id, 5*time.Second); err != nil {
+			t.Fatalf("WaitForFanout: %s", err)
+		}
+
+		itemKey := ItemKey(id)
+		promoted := s.ItemScore(itemKey, maybeKey("bob", ORDERING_TS))
+
+		item, err := s.Item(id)
+		if err != nil {
+			t.Fatalf("Item: %s", err)
+		}
+
+		// Becoming an event moves every entry to the event time
+		item.Event = time.Now().Add(24 * time.Hour).UnixNano()
+		if err := s.EditItem(item); err != nil {
+			t.Fatalf("EditItem: %s", err)
+		}
+		for _, pid := range []PidType{"alice", "bob"} {
+			if ts := s.ItemScore(itemKey, maybeKey(pid, ORDERING_TS)); !sameScore(ts, item.Event) {
+				t.Errorf("%s's entry has score %d, want the event time %d", pid, ts, item.Event)
+			}
+		}
+
+		// Ceasing to be an event only moves the author's entry back
+		event := item.Event
+		item.Event = 0
+		if err := s.EditItem(item); err != nil {
+			t.Fatalf("EditItem: %s", err)
+		}
+		if ts := s.ItemScore(itemKey, maybeKey("alice", ORDERING_TS)); !sameScore(ts, item.Added) {
+			t.Errorf("alice's entry has score %d, want the added time %d", ts, item.Added)
+		}
+		if ts := s.ItemScore(itemKey, maybeKey("bob", ORDERING_TS)); !sameScore(ts, event) || sameScore(ts, promoted) {
+			t.Errorf("bob's entry has score %d, want it kept at %d", ts, event)
+		}
+	})
+}
+
+// Forgets the promoters of an item, as for items promoted before they were
+// recorded
+func clearTestPromoters(s Store, itemKey string) {
+	switch s := s.(type) {
+	case *RedisStore:
+		s.tdb.Command("DEL", promotersKey(itemKey))
+	case *MemoryStore:
+		s.tdb.del(promotersKey(itemKey))
+	}
+}
+
+func TestRebuildPromotersIndex(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		addTestProfile(t, s, "bob")
+
+		id := addTestItem(t, s, "alice", "hello")
+		if err := s.Promote("bob", id); err != nil {
+			t.Fatalf("Promote: %s", err)
+		}
+		clearTestPromoters(s, ItemKey(id))
+
+		n, err := s.RebuildPromotersIndex()
+		if err != nil || n != 1 {
+			t.Fatalf("RebuildPromotersIndex = %d, %v, want 1", n, err)
+		}
+
+		if err := s.DeleteItem(id); err != nil {
+			t.Fatalf("DeleteItem: %s", err)
+		}
+		if ids := timelineIds(t, s, "bob", "m"); len(ids) != 0 {
+			t.Errorf("bob's maybe timeline = %v, want none", ids)
+		}
+	})
+}
+
+func TestRemoveProfileTimelines(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		addTestProfile(t, s, "bob")
+
+		if err := s.Follow("alice", "bob"); err != nil {
+			t.Fatalf("Follow: %s", err)
+		}
+		addTestItem(t, s, "bob", "hello")
+		if ids := timelineIds(t, s, "alice", "p"); len(ids) != 1 {
+			t.Fatalf("alice's possibly timeline = %v, want one item", ids)
+		}
+
+		// The timelines are in the timeline database, not the profile database
+		if err := s.RemoveProfile("alice"); err != nil {
+			t.Fatalf("RemoveProfile: %s", err)
+		}
+		if ids := timelineIds(t, s, "alice", "p"); len(ids) != 0 {
+			t.Errorf("alice's possibly timeline = %v after removal, want none", ids)
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package datastore
+
+import (
+	"cgl.tideland.biz/applog"
+	"code.google.com/p/tcgl/redis"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Failed logins are counted in the session database against both the pid and
+// the client they came from, e.g. the client's IP address. Once either count
+// reaches Config.Login.MaxFailures further logins are refused for a lockout
+// period that doubles with each further failure. Counts are forgotten after
+// Config.Login.Window seconds without a failure. A negative MaxFailures or
+// Lockout turns throttling off.
+
+const (
+	throttlePid    = "pid"
+	throttleClient = "client"
+)
+
+// LockoutError is returned when a login is refused because of too many
+// failed attempts
+type LockoutError struct {
+	Pid    PidType
+	Client string // empty when the pid is locked
+	Until  time.Time
+}
+
+func (e *LockoutError) Error() string {
+	if e.Client != "" {
+		return fmt.Sprintf("datastore: too many failed logins from %s, try again after %s", e.Client, e.Until.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("datastore: too many failed logins for %s, try again after %s", e.Pid, e.Until.Format(time.RFC3339))
+}
+
+// IsLockedOut reports whether err is a *LockoutError
+func IsLockedOut(err error) bool {
+	_, ok := err.(*LockoutError)
+	return ok
+}
+
+func loginFailuresKey(kind string, id string) string {
+	return fmt.Sprintf("loginfailures:%s:%s", kind, id)
+}
+
+func loginLockKey(kind string, id string) string {
+	return fmt.Sprintf("loginlock:%s:%s", kind, id)
+}
+
+// The lockout after the given number of failures, or zero if there is none
+func (c LoginConfig) lockout(failures int64) time.Duration {
+	if c.MaxFailures < 0 || c.Lockout < 0 || failures < int64(c.MaxFailures) {
+		return 0
+	}
+
+	seconds := float64(c.Lockout) * math.Pow(2, float64(failures-int64(c.MaxFailures)))
+	if c.MaxLockout > 0 && seconds > float64(c.MaxLockout) {
+		seconds = float64(c.MaxLockout)
+	}
+
+	// Without a MaxLockout the doubling soon passes the longest Duration
+	if longest := float64(math.MaxInt64 / int64(time.Second)); seconds > longest {
+		seconds = longest
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// Returns a *LockoutError if the pid or client is locked
+func (s *RedisStore) checkLoginLock(pid PidType, client string) error {
+	locks := [][2]string{{throttlePid, string(pid)}}
+	if client != "" {
+		locks = append(locks, [2]string{throttleClient, client})
+	}
+
+	for _, l := range locks {
+		rs := s.sdb.Command("TTL", loginLockKey(l[0], l[1]))
+		if !rs.IsOK() {
+			return rs.Error()
+		}
+		if ttl, _ := rs.ValueAsInt64(); ttl > 0 {
+			e := &LockoutError{Pid: pid, Until: time.Now().Add(time.Duration(ttl) * time.Second)}
+			if l[0] == throttleClient {
+				e.Client = client
+			}
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Counts a failed login and locks the pid or client when there have been too
+// many
+func (s *RedisStore) recordLoginFailure(kind string, id string) {
+	key := loginFailuresKey(kind, id)
+	rs := s.sdb.MultiCommand(func(mc *redis.MultiCommand) {
+		mc.Command("INCR", key)
+		mc.Command("EXPIRE", key, s.config.Login.Window)
+	})
+	if !rs.IsOK() {
+		applog.Errorf("Could not record failed login for %s %s: %s", kind, id, rs.Error().Error())
+		return
+	}
+
+	n, _ := rs.ResultSetAt(0).ValueAsInt64()
+	if lock := s.config.Login.lockout(n); lock > 0 {
+		applog.Infof("Locking logins for %s %s for %s", kind, id, lock)
+		rs = s.sdb.Command("SET", loginLockKey(kind, id), n, "EX", int64(lock/time.Second))
+		if !rs.IsOK() {
+			applog.Errorf("Could not lock logins for %s %s: %s", kind, id, rs.Error().Error())
+		}
+	}
+}
+
+// VerifyPasswordFrom checks the password for pid as VerifyPassword does,
+// counting failures against both pid and client. A *LockoutError is returned
+// without checking the password if either is locked out. An empty client
+// only counts failures against pid.
+func (s *RedisStore) VerifyPasswordFrom(pid PidType, password string, client string) (bool, error) {
+	if err := s.checkLoginLock(pid, client); err != nil {
+		return false, err
+	}
+
+	ok, err := s.checkPasswordHash(pid, password)
+	if err == ErrIncorrectPassword || isKeyNotFound(err) {
+		s.recordLoginFailure(throttlePid, string(pid))
+		if client != "" {
+			s.recordLoginFailure(throttleClient, client)
+		}
+		return ok, err
+	}
+	if err != nil {
+		return ok, err
+	}
+
+	rs := s.sdb.Command("DEL", loginFailuresKey(throttlePid, string(pid)))
+	if !rs.IsOK() {
+		applog.Errorf("Could not clear failed logins for %s: %s", pid, rs.Error().Error())
+	}
+
+	return ok, nil
+}
+
+// Clears the failed login count and any lockout for pid
+func (s *RedisStore) UnlockLogin(pid PidType) error {
+	rs := s.sdb.Command("DEL", loginFailuresKey(throttlePid, string(pid)), loginLockKey(throttlePid, string(pid)))
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+// Clears the failed login count and any lockout for a client
+func (s *RedisStore) UnlockClient(client string) error {
+	rs := s.sdb.Command("DEL", loginFailuresKey(throttleClient, client), loginLockKey(throttleClient, client))
+	if !rs.IsOK() {
+		return rs.Error()
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) checkLoginLock(pid PidType, client string) error {
+	locks := [][2]string{{throttlePid, string(pid)}}
+	if client != "" {
+		locks = append(locks, [2]string{throttleClient, client})
+	}
+
+	for _, l := range locks {
+		if ttl := s.sdb.ttl(loginLockKey(l[0], l[1])); ttl > 0 {
+			e := &LockoutError{Pid: pid, Until: time.Now().Add(ttl)}
+			if l[0] == throttleClient {
+				e.Client = client
+			}
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) recordLoginFailure(kind string, id string) {
+	key := loginFailuresKey(kind, id)
+	n := s.sdb.incr(key)
+	s.sdb.expire(key, time.Duration(s.config.Login.Window)*time.Second)
+
+	if lock := s.config.Login.lockout(n); lock > 0 {
+		s.sdb.set(loginLockKey(kind, id), fmt.Sprintf("%d", n))
+		s.sdb.expire(loginLockKey(kind, id), lock)
+	}
+}
+
+func (s *MemoryStore) VerifyPasswordFrom(pid PidType, password string, client string) (bool, error) {
+	if err := s.checkLoginLock(pid, client); err != nil {
+		return false, err
+	}
+
+	ok, err := s.checkPasswordHash(pid, password)
+	if err == ErrIncorrectPassword || isKeyNotFound(err) {
+		s.recordLoginFailure(throttlePid, string(pid))
+		if client != "" {
+			s.recordLoginFailure(throttleClient, client)
+		}
+		return ok, err
+	}
+	if err != nil {
+		return ok, err
+	}
+
+	s.sdb.del(loginFailuresKey(throttlePid, string(pid)))
+	return ok, nil
+}
+
+func (s *MemoryStore) UnlockLogin(pid PidType) error {
+	s.sdb.del(loginFailuresKey(throttlePid, string(pid)), loginLockKey(throttlePid, string(pid)))
+	return nil
+}
+
+func (s *MemoryStore) UnlockClient(client string) error {
+	s.sdb.del(loginFailuresKey(throttleClient, client), loginLockKey(throttleClient, client))
+	return nil
+}
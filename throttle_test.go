@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	c := LoginConfig{MaxFailures: 5, Lockout: 60, MaxLockout: 3600}
+
+	lockouts := []struct {
+		failures int64
+		want     time.Duration
+	}{
+		{4, 0},
+		{5, time.Minute},
+		{7, 4 * time.Minute},
+		{100, time.Hour},
+	}
+	for _, l := range lockouts {
+		if got := c.lockout(l.failures); got != l.want {
+			t.Errorf("lockout(%d) = %s, want %s", l.failures, got, l.want)
+		}
+	}
+
+	// Without a maximum the lockout stops at the longest Duration
+	c.MaxLockout = 0
+	for _, failures := range []int64{40, 100, 2000} {
+		if got := c.lockout(failures); got <= 0 || got > time.Duration(math.MaxInt64) {
+			t.Errorf("lockout(%d) = %s, want a long positive lockout", failures, got)
+		}
+	}
+}
+
+func TestLoginThrottleDefaults(t *testing.T) {
+	config := testConfig("")
+	config.Login.MaxFailures = 0
+	config.Login.Lockout = 0
+
+	// Unset limits are defaulted rather than turning throttling off
+	c := config.withDefaults().Login
+	if c.MaxFailures != DefaultConfig.Login.MaxFailures || c.Lockout != DefaultConfig.Login.Lockout {
+		t.Errorf("login config = %+v, want the default limits", c)
+	}
+	if got := c.lockout(int64(c.MaxFailures)); got <= 0 {
+		t.Errorf("lockout(%d) = %s, want a lockout", c.MaxFailures, got)
+	}
+
+	// Negative limits turn it off
+	for _, off := range []LoginConfig{{MaxFailures: -1, Lockout: 60}, {MaxFailures: 5, Lockout: -1}} {
+		config.Login = off
+		c := config.withDefaults().Login
+		if got := c.lockout(100); got != 0 {
+			t.Errorf("lockout(100) with %+v = %s, want none", off, got)
+		}
+	}
+}
+
+func TestZeroLoginWindow(t *testing.T) {
+	config := testConfig("")
+	config.Login.Window = 0
+
+	stores := []Store{NewMemoryStore(config, nil)}
+	if !testing.Short() {
+		redisConfig := testRedisConfig(t)
+		redisConfig.Login.Window = 0
+		s := newTestRedisStoreFrom(t, redisConfig)
+		defer s.Close()
+		stores = append(stores, s)
+	}
+
+	// Failures are remembered rather than expiring at once
+	for _, s := range stores {
+		addTestProfile(t, s, "alice")
+		for i := 0; i < config.Login.MaxFailures; i++ {
+			if ok, _ := s.VerifyPasswordFrom("alice", "wrong", "client"); ok {
+				t.Fatalf("%T accepted a wrong password", s)
+			}
+		}
+		if _, err := s.VerifyPasswordFrom("alice", "secret", "client"); !IsLockedOut(err) {
+			t.Errorf("%T VerifyPasswordFrom after %d failures = %v, want a lockout", s, config.Login.MaxFailures, err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("datastore: invalid timeline cursor")
+
+const (
+	cursorOlder = "o"
+	cursorNewer = "n"
+)
+
+type scoredMember struct {
+	member string
+	score  float64
+}
+
+// scoreRange is the equivalent of the min and max arguments to ZRANGEBYSCORE
+type scoreRange struct {
+	min          float64
+	max          float64
+	minExclusive bool
+	maxExclusive bool
+}
+
+func (r scoreRange) contains(score float64) bool {
+	if score < r.min || (r.minExclusive && score == r.min) {
+		return false
+	}
+	if score > r.max || (r.maxExclusive && score == r.max) {
+		return false
+	}
+	return true
+}
+
+// Formats the bounds of the range as arguments for ZRANGEBYSCORE
+func (r scoreRange) args() (string, string) {
+	return scoreArg(r.min, r.minExclusive), scoreArg(r.max, r.maxExclusive)
+}
+
+func scoreArg(score float64, exclusive bool) string {
+	var arg string
+	switch {
+	case math.IsInf(score, 1):
+		arg = "+inf"
+	case math.IsInf(score, -1):
+		arg = "-inf"
+	default:
+		arg = strconv.FormatFloat(score, 'f', -1, 64)
+	}
+
+	if exclusive {
+		return "(" + arg
+	}
+	return arg
+}
+
+// byScore orders members in the same way as a redis sorted set
+type byScore []scoredMember
+
+func (s byScore) Len() int      { return len(s) }
+func (s byScore) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool {
+	if s[i].score == s[j].score {
+		return s[i].member < s[j].member
+	}
+	return s[i].score < s[j].score
+}
+
+func timelineKey(pid PidType, status string) string {
+	if status == "p" {
+		return possiblyKey(pid, ORDERING_TS)
+	}
+	return maybeKey(pid, ORDERING_TS)
+}
+
+// timelineWindow is the range of scores for items scheduled from tstart up to
+// but not including tend
+func timelineWindow(tstart time.Time, tend time.Time) scoreRange {
+	return scoreRange{min: itemScore(tstart), max: itemScore(tend), maxExclusive: true}
+}
+
+// timelineCursor is a position in a timeline. Positions are ordered by score
+// then by item key so items sharing a score are never skipped or repeated.
+type timelineCursor struct {
+	newer   bool
+	score   float64
+	itemKey string
+}
+
+func (c *timelineCursor) String() string {
+	dir := cursorOlder
+	if c.newer {
+		dir = cursorNewer
+	}
+	raw := fmt.Sprintf("%s|%s|%s", dir, strconv.FormatFloat(c.score, 'f', -1, 64), c.itemKey)
+	return base64.URLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseTimelineCursor(cursor string) (*timelineCursor, error) {
+	raw, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	parts := strings.SplitN(string(raw), "|", 3)
+	if len(parts) != 3 || (parts[0] != cursorOlder && parts[0] != cursorNewer) || parts[2] == "" {
+		return nil, ErrInvalidCursor
+	}
+
+	score, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &timelineCursor{newer: parts[0] == cursorNewer, score: score, itemKey: parts[2]}, nil
+}
+
+// timelineScanner reads a range of a sorted set in the manner of
+// ZRANGEBYSCORE, or ZREVRANGEBYSCORE when reverse is true. A negative count
+// returns all matching members.
+type timelineScanner interface {
+	scanTimeline(timelineKey string, r scoreRange, count int, reverse bool) ([]scoredMember, error)
+}
+
+// timelinePage selects up to count members of a timeline starting from the
+// position given by cursor. Members are returned newest first along with the
+// cursors for the adjacent pages, which are empty when there is nothing
+// further in that direction. An empty page still returns cursors at the
+// position of the cursor passed in.
+func timelinePage(scanner timelineScanner, timelineKey string, cursor string, count int) (members []scoredMember, next string, prev string, err error) {
+	if count <= 0 {
+		return nil, "", "", fmt.Errorf("page size must be positive")
+	}
+
+	// Read one more than needed to find out if there is another page
+	want := count + 1
+
+	var c *timelineCursor
+	if cursor != "" {
+		if c, err = parseTimelineCursor(cursor); err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	members = make([]scoredMember, 0, want)
+
+	switch {
+	case c == nil:
+		members, err = scanner.scanTimeline(timelineKey, scoreRange{min: math.Inf(-1), max: math.Inf(1)}, want, true)
+		if err != nil {
+			return nil, "", "", err
+		}
+
+	case c.newer:
+		tied, err := scanner.scanTimeline(timelineKey, scoreRange{min: c.score, max: c.score}, -1, false)
+		if err != nil {
+			return nil, "", "", err
+		}
+		for _, m := range tied {
+			if m.member > c.itemKey && len(members) < want {
+				members = append(members, m)
+			}
+		}
+
+		if len(members) < want {
+			more, err := scanner.scanTimeline(timelineKey, scoreRange{min: c.score, max: math.Inf(1), minExclusive: true}, want-len(members), false)
+			if err != nil {
+				return nil, "", "", err
+			}
+			members = append(members, more...)
+		}
+
+	default:
+		tied, err := scanner.scanTimeline(timelineKey, scoreRange{min: c.score, max: c.score}, -1, true)
+		if err != nil {
+			return nil, "", "", err
+		}
+		for _, m := range tied {
+			if m.member < c.itemKey && len(members) < want {
+				members = append(members, m)
+			}
+		}
+
+		if len(members) < want {
+			more, err := scanner.scanTimeline(timelineKey, scoreRange{min: math.Inf(-1), max: c.score, maxExclusive: true}, want-len(members), true)
+			if err != nil {
+				return nil, "", "", err
+			}
+			members = append(members, more...)
+		}
+	}
+
+	hasMore := len(members) > count
+	if hasMore {
+		members = members[:count]
+	}
+
+	if len(members) == 0 {
+		if c == nil {
+			return members, "", "", nil
+		}
+
+		// Keep the client's place so it can go back, or wait for newer items
+		if c.newer {
+			back := &timelineCursor{newer: false, score: c.score, itemKey: c.itemKey}
+			return members, back.String(), cursor, nil
+		}
+		back := &timelineCursor{newer: true, score: c.score, itemKey: c.itemKey}
+		return members, "", back.String(), nil
+	}
+
+	if c != nil && c.newer {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+
+	first, last := members[0], members[len(members)-1]
+	prevCursor := &timelineCursor{newer: true, score: first.score, itemKey: first.member}
+	nextCursor := &timelineCursor{newer: false, score: last.score, itemKey: last.member}
+
+	// The cursor pointing back the way we came is always returned so clients
+	// can pick up items inserted after the page was read
+	if c != nil && c.newer {
+		next = nextCursor.String()
+		if hasMore {
+			prev = prevCursor.String()
+		}
+	} else {
+		prev = prevCursor.String()
+		if hasMore {
+			next = nextCursor.String()
+		}
+	}
+
+	return members, next, prev, nil
+}
+
+// newTimelineRange builds the response envelope for a page of items ordered
+// newest first
+func newTimelineRange(pid PidType, items []*FormattedItem, next string, prev string) *TimelineRange {
+	tr := &TimelineRange{
+		Pid:   string(pid),
+		Items: items,
+		Next:  next,
+		Prev:  prev,
+	}
+
+	if len(items) > 0 {
+		tr.Tend = time.Unix(0, items[0].Ts)
+		tr.Tstart = time.Unix(0, items[len(items)-1].Ts)
+	}
+
+	return tr
+}
@@ -0,0 +1,92 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+const benchTimelineSize = 50
+
+// Fills a timeline with items from several authors, some seen via a
+// promoter, and returns its members
+func benchTimeline(b *testing.B, s *RedisStore) []scoredMember {
+	for i := 0; i < 5; i++ {
+		pid := PidType(fmt.Sprintf("author%d", i))
+		if err := s.AddProfile(pid, "secret", string(pid), "", "", "", "", "", "", "", "", "", ""); err != nil {
+			b.Fatalf("AddProfile: %s", err)
+		}
+	}
+
+	now := time.Now()
+	for i := 0; i < benchTimelineSize; i++ {
+		item := &Item{
+			Id:    ItemIdType(fmt.Sprintf("item%d", i)),
+			Pid:   PidType(fmt.Sprintf("author%d", i%5)),
+			Text:  "text",
+			Added: now.UnixNano(),
+		}
+		if _, err := s.SaveItem(item, 0); err != nil {
+			b.Fatalf("SaveItem: %s", err)
+		}
+
+		source := item.Pid
+		if i%3 == 0 {
+			source = PidType(fmt.Sprintf("author%d", (i+1)%5))
+		}
+		if err := s.AddItemToTimeline("reader", source, now.Add(time.Duration(i)*time.Second).UnixNano(), item.Key()); err != nil {
+			b.Fatalf("AddItemToTimeline: %s", err)
+		}
+	}
+
+	members, err := s.scanTimeline(possiblyKey("reader", ORDERING_TS), scoreRange{min: 0, max: float64(now.Add(time.Hour).UnixNano())}, -1, true)
+	if err != nil {
+		b.Fatalf("scanTimeline: %s", err)
+	}
+	return members
+}
+
+// Formats a timeline one item at a time, as was done before items, sources
+// and profiles were read in batches
+func formatTimelineItemsPerItem(s *RedisStore, pid PidType, members []scoredMember) ([]*FormattedItem, error) {
+	items := make([]*FormattedItem, 0, len(members))
+	for _, m := range members {
+		item, err := s.ItemByKey(m.member)
+		if err != nil {
+			return nil, err
+		}
+
+		fitem, err := s.FormatItem(item, int64(m.score), pid)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, fitem)
+	}
+	return items, nil
+}
+
+func benchmarkFormatTimeline(b *testing.B, format func(s *RedisStore, pid PidType, members []scoredMember) ([]*FormattedItem, error)) {
+	s := newTestRedisStore(b)
+	defer s.Close()
+
+	members := benchTimeline(b, s)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		items, err := format(s, "reader", members)
+		if err != nil {
+			b.Fatalf("format: %s", err)
+		}
+		if len(items) != benchTimelineSize {
+			b.Fatalf("formatted %d items, want %d", len(items), benchTimelineSize)
+		}
+	}
+}
+
+func BenchmarkFormatTimelineBatched(b *testing.B) {
+	benchmarkFormatTimeline(b, (*RedisStore).formatTimelineItems)
+}
+
+func BenchmarkFormatTimelinePerItem(b *testing.B) {
+	benchmarkFormatTimeline(b, formatTimelineItemsPerItem)
+}
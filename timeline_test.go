@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"testing"
+)
+
+func pageIds(tr *TimelineRange) []ItemIdType {
+	ids := make([]ItemIdType, 0, len(tr.Items))
+	for _, item := range tr.Items {
+		ids = append(ids, item.Id)
+	}
+	return ids
+}
+
+func TestTimelinePage(t *testing.T) {
+	forEachStore(t, func(t *testing.T, s Store) {
+		addTestProfile(t, s, "alice")
+		a := addTestItem(t, s, "alice", "a")
+		b := addTestItem(t, s, "alice", "b")
+		c := addTestItem(t, s, "alice", "c")
+
+		first, err := s.TimelinePage("alice", "m", "", 2)
+		if err != nil {
+			t.Fatalf("TimelinePage: %s", err)
+		}
+		if ids := pageIds(first); !sameIds(ids, c, b) || first.Next == "" || first.Prev == "" {
+			t.Fatalf("first page = %v next %q prev %q", ids, first.Next, first.Prev)
+		}
+
+		second, err := s.TimelinePage("alice", "m", first.Next, 2)
+		if err != nil {
+			t.Fatalf("TimelinePage: %s", err)
+		}
+		if ids := pageIds(second); !sameIds(ids, a) || second.Next != "" || second.Prev == "" {
+			t.Fatalf("second page = %v next %q prev %q", ids, second.Next, second.Prev)
+		}
+
+		back, err := s.TimelinePage("alice", "m", second.Prev, 2)
+		if err != nil {
+			t.Fatalf("TimelinePage: %s", err)
+		}
+		if ids := pageIds(back); !sameIds(ids, c, b) {
+			t.Fatalf("page before second = %v, want %v %v", ids, c, b)
+		}
+
+		// Nothing is newer than the first page, but the cursor is kept so
+		// newer items can be polled for
+		newer, err := s.TimelinePage("alice", "m", first.Prev, 2)
+		if err != nil {
+			t.Fatalf("TimelinePage: %s", err)
+		}
+		if len(newer.Items) != 0 || newer.Prev != first.Prev || newer.Next == "" {
+			t.Fatalf("newer page = %v next %q prev %q", pageIds(newer), newer.Next, newer.Prev)
+		}
+
+		d := addTestItem(t, s, "alice", "d")
+		polled, err := s.TimelinePage("alice", "m", newer.Prev, 2)
+		if err != nil {
+			t.Fatalf("TimelinePage: %s", err)
+		}
+		if ids := pageIds(polled); !sameIds(ids, d) {
+			t.Fatalf("polled page = %v, want %v", ids, d)
+		}
+
+		// An older page emptied by a removal keeps the way back
+		if err := s.Demote("alice", a); err != nil {
+			t.Fatalf("Demote: %s", err)
+		}
+		older, err := s.TimelinePage("alice", "m", first.Next, 2)
+		if err != nil {
+			t.Fatalf("TimelinePage: %s", err)
+		}
+		if len(older.Items) != 0 || older.Next != "" || older.Prev == "" {
+			t.Fatalf("older page = %v next %q prev %q", pageIds(older), older.Next, older.Prev)
+		}
+
+		back, err = s.TimelinePage("alice", "m", older.Prev, 2)
+		if err != nil {
+			t.Fatalf("TimelinePage: %s", err)
+		}
+		if ids := pageIds(back); !sameIds(ids, d, c) {
+			t.Fatalf("page before older = %v, want %v %v", ids, d, c)
+		}
+	})
+}
@@ -0,0 +1,413 @@
+package datastore
+
+import (
+	"bytes"
+	"cgl.tideland.biz/applog"
+	_ "code.google.com/p/go.image/webp"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/iand/salience"
+	"github.com/nfnt/resize"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+)
+
+// Ways of fitting an image to a variant's dimensions
+const (
+	CropSalience = "salience" // scale to cover then crop to the most interesting region
+	CropCentre   = "centre"   // scale to cover then crop the centre
+	CropFit      = "fit"      // scale to fit within the dimensions without cropping
+)
+
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+)
+
+// The name of the variant holding an animated image unchanged when
+// Config.Images.KeepAnimated is set
+const AnimatedVariant = "animated"
+
+var ErrNoImageVariants = errors.New("datastore: no image variants configured")
+
+// ImageVariant is a named rendition of an item's image
+type ImageVariant struct {
+	Name    string `toml:"name"`
+	Width   int    `toml:"width"`
+	Height  int    `toml:"height"`
+	Crop    string `toml:"crop"`
+	Format  string `toml:"format"`
+	Quality int    `toml:"quality"` // jpeg only
+}
+
+// Render produces the variant of img. Images are never scaled up.
+func (v *ImageVariant) Render(img image.Image) image.Image {
+	switch v.Crop {
+	case CropFit:
+		return scaleImage(img, v.Width, v.Height, math.Min)
+	case CropCentre:
+		return cropCentre(scaleImage(img, v.Width, v.Height, math.Max), v.Width, v.Height)
+	default:
+		return salience.Crop(scaleImage(img, v.Width, v.Height, math.Max), v.Width, v.Height)
+	}
+}
+
+func (v *ImageVariant) Encode(w io.Writer, img image.Image) error {
+	if v.Format == FormatJPEG {
+		quality := v.Quality
+		if quality <= 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+	return png.Encode(w, img)
+}
+
+func (v *ImageVariant) Ext() string {
+	if v.Format == FormatJPEG {
+		return "jpg"
+	}
+	return "png"
+}
+
+// Scales img by the smaller (choose is math.Min) or larger (math.Max) of the
+// ratios needed to match width and height
+func scaleImage(img image.Image, width int, height int, choose func(float64, float64) float64) image.Image {
+	b := img.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return img
+	}
+
+	scale := choose(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+	if scale >= 1 {
+		return img
+	}
+
+	w := uint(math.Ceil(float64(b.Dx()) * scale))
+	h := uint(math.Ceil(float64(b.Dy()) * scale))
+	return resize.Resize(w, h, img, resize.Lanczos3)
+}
+
+func cropCentre(img image.Image, width int, height int) image.Image {
+	b := img.Bounds()
+	if width > b.Dx() {
+		width = b.Dx()
+	}
+	if height > b.Dy() {
+		height = b.Dy()
+	}
+
+	x := b.Min.X + (b.Dx()-width)/2
+	y := b.Min.Y + (b.Dy()-height)/2
+
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(out, out.Bounds(), img, image.Pt(x, y), draw.Src)
+	return out
+}
+
+// CachedImage records the variants saved from a remote image along with the
+// validators used to check whether the image has changed
+type CachedImage struct {
+	Url          string            `json:"url"`
+	ETag         string            `json:"etag,omitempty"`
+	LastModified string            `json:"lastmodified,omitempty"`
+	Variants     map[string]string `json:"variants"`
+}
+
+func cachedImageKey(url string) string {
+	hasher := md5.New()
+	io.WriteString(hasher, url)
+	return fmt.Sprintf("cachedimage:%x", hasher.Sum(nil))
+}
+
+// Reports whether every variant was saved when the image was cached
+func (c *CachedImage) hasVariants(variants []ImageVariant) bool {
+	for _, v := range variants {
+		if _, exists := c.Variants[v.Name]; !exists {
+			return false
+		}
+	}
+	return true
+}
+
+// Decodes an image, checking its dimensions against maxPixels before the
+// pixels are decoded. Only the first frame of an animated GIF is decoded.
+func decodeImage(data []byte, maxPixels int) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, Permanent(err)
+	}
+
+	if maxPixels > 0 && config.Width*config.Height > maxPixels {
+		return nil, Permanent(fmt.Errorf("image is %dx%d, more than %d pixels", config.Width, config.Height, maxPixels))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, Permanent(err)
+	}
+
+	return img, nil
+}
+
+// CacheImageVariants fetches the image at url and saves each of the
+// configured variants in images. When previous describes an earlier caching
+// of the same url the request is conditional, and previous is returned if the
+// image hasn't changed.
+func CacheImageVariants(url string, fetcher Fetcher, images ImageStore, config ImageConfig, previous *CachedImage) (*CachedImage, error) {
+	if images == nil {
+		return nil, ErrNoImageStore
+	}
+	if len(config.Variants) == 0 {
+		return nil, ErrNoImageVariants
+	}
+
+	etag, lastModified := "", ""
+	if previous != nil && previous.Url == url && previous.hasVariants(config.Variants) {
+		etag, lastModified = previous.ETag, previous.LastModified
+	}
+
+	res, err := fetcher.Fetch(url, config.Types, etag, lastModified)
+	if err == ErrNotModified {
+		return previous, nil
+	}
+	if err != nil {
+		applog.Errorf("Error fetching image from %s: %s", url, err.Error())
+		return nil, err
+	}
+
+	img, err := decodeImage(res.Body, config.MaxPixels)
+	if err != nil {
+		applog.Errorf("Error decoding image from %s: %s", url, err.Error())
+		return nil, err
+	}
+
+	hasher := md5.New()
+	io.WriteString(hasher, url)
+	id := fmt.Sprintf("%x", hasher.Sum(nil))
+
+	cached := &CachedImage{
+		Url:          url,
+		ETag:         res.ETag,
+		LastModified: res.LastModified,
+		Variants:     make(map[string]string, len(config.Variants)),
+	}
+
+	for i := range config.Variants {
+		v := &config.Variants[i]
+		out := v.Render(img)
+
+		name, err := images.Save(id+"-"+v.Name, v.Ext(), func(w io.Writer) error {
+			return v.Encode(w, out)
+		})
+		if err != nil {
+			applog.Errorf("Error saving %s image from %s: %s", v.Name, url, err.Error())
+			return nil, err
+		}
+		cached.Variants[v.Name] = name
+	}
+
+	if config.KeepAnimated && isAnimatedGIF(res.Body, config.MaxPixels) {
+		name, err := images.Save(id+"-"+AnimatedVariant, "gif", func(w io.Writer) error {
+			_, err := w.Write(res.Body)
+			return err
+		})
+		if err != nil {
+			applog.Errorf("Error saving animated image from %s: %s", url, err.Error())
+			return nil, err
+		}
+		cached.Variants[AnimatedVariant] = name
+	}
+
+	return cached, nil
+}
+
+var errBadGIF = errors.New("datastore: malformed gif")
+
+// Reports whether data is an animated GIF whose frames together have no more
+// than maxPixels pixels, so that clients can be trusted to decode it. None of
+// the frames are decoded.
+func isAnimatedGIF(data []byte, maxPixels int) bool {
+	if !bytes.HasPrefix(data, []byte("GIF8")) {
+		return false
+	}
+
+	frames, err := gifFrameCount(data)
+	if err != nil || frames < 2 {
+		return false
+	}
+
+	config, err := gif.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+
+	if maxPixels > 0 && int64(frames)*int64(config.Width)*int64(config.Height) > int64(maxPixels) {
+		applog.Debugf("Not keeping animated image of %d %dx%d frames, more than %d pixels", frames, config.Width, config.Height, maxPixels)
+		return false
+	}
+
+	return true
+}
+
+// Counts the frames of a GIF by walking its blocks
+func gifFrameCount(data []byte) (int, error) {
+	// Header and logical screen descriptor
+	pos := 13
+	if len(data) < pos {
+		return 0, errBadGIF
+	}
+	pos += gifColorTableSize(data[10])
+
+	// Skips a sequence of data sub-blocks ending with an empty one
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return errBadGIF
+			}
+			n := int(data[pos])
+			pos += 1 + n
+			if n == 0 {
+				return nil
+			}
+		}
+	}
+
+	frames := 0
+	for {
+		if pos >= len(data) {
+			return frames, errBadGIF
+		}
+
+		switch data[pos] {
+		case 0x21: // extension
+			pos += 2
+			if err := skipSubBlocks(); err != nil {
+				return frames, err
+			}
+
+		case 0x2C: // image descriptor
+			if pos+10 > len(data) {
+				return frames, errBadGIF
+			}
+			pos += 10 + gifColorTableSize(data[pos+9])
+
+			// LZW minimum code size then the image data
+			pos++
+			if err := skipSubBlocks(); err != nil {
+				return frames, err
+			}
+			frames++
+
+		case 0x3B: // trailer
+			return frames, nil
+
+		default:
+			return frames, errBadGIF
+		}
+	}
+}
+
+// Returns the size in bytes of the colour table described by the packed
+// field of a screen or image descriptor
+func gifColorTableSize(packed byte) int {
+	if packed&0x80 == 0 {
+		return 0
+	}
+	return 3 << (uint(packed&0x07) + 1)
+}
+
+// Makes the cached image the item's image. The first variant becomes the
+// item's main image.
+func setItemImage(item *Item, cached *CachedImage, variants []ImageVariant) {
+	item.Image = cached.Variants[variants[0].Name]
+	item.Images = cached.Variants
+}
+
+// Caches the image at url, reusing the variants cached before if the remote
+// image hasn't changed
+func (s *RedisStore) cacheImage(url string) (*CachedImage, error) {
+	key := cachedImageKey(url)
+
+	var previous *CachedImage
+	rs := s.pdb.Command("GET", key)
+	if rs.IsOK() {
+		previous = &CachedImage{}
+		if err := json.Unmarshal([]byte(rs.ValueAsString()), previous); err != nil {
+			previous = nil
+		}
+	}
+
+	cached, err := CacheImageVariants(url, s.fetcher, s.images, s.config.Images, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return nil, err
+	}
+
+	rs = s.pdb.Command("SET", key, data)
+	if !rs.IsOK() {
+		applog.Errorf("Could not record cached image for %s: %s", url, rs.Error().Error())
+	}
+
+	return cached, nil
+}
+
+// Caches the item's image in every configured variant. The image is left as
+// it is if it could not be cached.
+func (s *RedisStore) cacheItemImage(item *Item) error {
+	applog.Debugf("Caching image from %s", item.Image)
+
+	cached, err := s.cacheImage(item.Image)
+	if err != nil {
+		return err
+	}
+
+	setItemImage(item, cached, s.config.Images.Variants)
+	return nil
+}
+
+func (s *MemoryStore) cacheImage(url string) (*CachedImage, error) {
+	key := cachedImageKey(url)
+
+	var previous *CachedImage
+	if val, err := s.pdb.get(key); err == nil {
+		previous = &CachedImage{}
+		if err := json.Unmarshal([]byte(val), previous); err != nil {
+			previous = nil
+		}
+	}
+
+	cached, err := CacheImageVariants(url, s.fetcher, s.images, s.config.Images, previous)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(cached)
+	if err != nil {
+		return nil, err
+	}
+	s.pdb.set(key, string(data))
+
+	return cached, nil
+}
+
+func (s *MemoryStore) cacheItemImage(item *Item) error {
+	cached, err := s.cacheImage(item.Image)
+	if err != nil {
+		return err
+	}
+
+	setItemImage(item, cached, s.config.Images.Variants)
+	return nil
+}
@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"bytes"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+)
+
+func testGIF(t *testing.T, frames int, width int, height int) []byte {
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9))
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("EncodeAll: %s", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrameCount(t *testing.T) {
+	for _, frames := range []int{1, 2, 5} {
+		data := testGIF(t, frames, 20, 10)
+		if n, err := gifFrameCount(data); err != nil || n != frames {
+			t.Errorf("gifFrameCount = %d, %v, want %d", n, err, frames)
+		}
+	}
+
+	data := testGIF(t, 3, 20, 10)
+	if _, err := gifFrameCount(data[:len(data)-10]); err != errBadGIF {
+		t.Errorf("gifFrameCount of a truncated gif = %v, want %v", err, errBadGIF)
+	}
+}
+
+func TestIsAnimatedGIF(t *testing.T) {
+	animated := testGIF(t, 3, 20, 10)
+
+	if isAnimatedGIF(testGIF(t, 1, 20, 10), 0) {
+		t.Errorf("single frame gif is animated")
+	}
+	if !isAnimatedGIF(animated, 0) || !isAnimatedGIF(animated, 600) {
+		t.Errorf("animated gif within budget not animated")
+	}
+	if isAnimatedGIF(animated, 599) {
+		t.Errorf("animated gif of 600 pixels kept with a budget of 599")
+	}
+	if isAnimatedGIF([]byte("GIF89a"), 0) {
+		t.Errorf("truncated gif is animated")
+	}
+}